@@ -0,0 +1,301 @@
+package thrifttools
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TApplicationException type ids clients get for calls rejected by Auth.
+const (
+	ExceptionUnauthenticated  int32 = 103
+	ExceptionPermissionDenied int32 = 104
+)
+
+// IdentityKey is the Context key Auth stores the caller Identity under.
+const IdentityKey = "thrifttools.identity"
+
+// Identity is an authenticated caller.
+type Identity struct {
+	Name  string
+	Roles []string
+	//the authenticator that accepted the caller: token, mtls or hmac
+	Via string
+}
+
+// IdentityOf returns the caller Auth authenticated, nil for anonymous calls.
+func IdentityOf(c *Context) *Identity {
+	v, _ := c.Get(IdentityKey)
+	id, _ := v.(*Identity)
+	return id
+}
+
+// AuthError aborts the calls Auth rejects.
+type AuthError struct {
+	Method string
+	//the caller was authenticated but the ACL denies the method
+	Denied bool
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	if e.Denied {
+		return "permission denied calling " + e.Method + ": " + e.Reason
+	}
+	return "unauthenticated call to " + e.Method + ": " + e.Reason
+}
+
+func (e *AuthError) TypeId() int32 {
+	if e.Denied {
+		return ExceptionPermissionDenied
+	}
+	return ExceptionUnauthenticated
+}
+
+// Authenticator identifies the caller of c. It returns a nil Identity and
+// error when the call carries none of its credentials, and an error when
+// they are wrong.
+type Authenticator interface {
+	Authenticate(c *Context) (*Identity, error)
+}
+
+type AuthenticatorFunc func(c *Context) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(c *Context) (*Identity, error) {
+	return f(c)
+}
+
+var (
+	errBadToken     = errors.New("invalid token")
+	errBadSignature = errors.New("invalid signature")
+)
+
+// TokenAuthenticator accepts the shared tokens in the THeader header, with
+// an optional "Bearer " prefix, each token naming its caller.
+func TokenAuthenticator(header string, tokens map[string]*Identity) Authenticator {
+	return AuthenticatorFunc(func(c *Context) (*Identity, error) {
+		token, ok := c.RequestHeaders()[header]
+		if !ok {
+			return nil, nil
+		}
+		token = strings.TrimPrefix(token, "Bearer ")
+		var found *Identity
+		//compare every token, in constant time
+		for t, id := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				found = id
+			}
+		}
+		if found == nil {
+			return nil, errBadToken
+		}
+		id := *found
+		id.Via = "token"
+		return &id, nil
+	})
+}
+
+// MTLSAuthenticator names the caller by the common name of the verified TLS
+// client certificate, with the roles given for that name.
+func MTLSAuthenticator(roles map[string][]string) Authenticator {
+	return AuthenticatorFunc(func(c *Context) (*Identity, error) {
+		conn, ok := c.Conn().(*tls.Conn)
+		if !ok {
+			return nil, nil
+		}
+		state := conn.ConnectionState()
+		if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+			return nil, nil
+		}
+		name := state.PeerCertificates[0].Subject.CommonName
+		return &Identity{Name: name, Roles: roles[name], Via: "mtls"}, nil
+	})
+}
+
+// HMACAuthenticator accepts calls whose THeader header is
+// keyid:unixtime:nonce:signature, signed by SignHMAC with the key of keyid
+// no more than maxSkew ago. The signature covers the method and seqid of the
+// call, and a nonce is accepted once while its timestamp is in the window,
+// so a captured header cannot be replayed. It does not cover the arguments.
+// Each key names its caller.
+func HMACAuthenticator(header string, keys map[string][]byte, ids map[string]*Identity, maxSkew time.Duration) Authenticator {
+	var mu sync.Mutex
+	//nonces seen, with the time their signature expires
+	seen := make(map[string]time.Time)
+	var lastSweep time.Time
+	return AuthenticatorFunc(func(c *Context) (*Identity, error) {
+		value, ok := c.RequestHeaders()[header]
+		if !ok {
+			return nil, nil
+		}
+		parts := strings.SplitN(value, ":", 4)
+		if len(parts) != 4 || parts[2] == "" {
+			return nil, errBadSignature
+		}
+		key, ok := keys[parts[0]]
+		if !ok {
+			return nil, errBadSignature
+		}
+		unix, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, errBadSignature
+		}
+		now, signed := nowFun(), time.Unix(unix, 0)
+		if skew := now.Sub(signed); skew > maxSkew || skew < -maxSkew {
+			return nil, errors.New("signature expired")
+		}
+		want := signHMAC(key, parts[0], parts[1], parts[2], c.SeqId, c.Name)
+		if !hmac.Equal([]byte(want), []byte(parts[3])) {
+			return nil, errBadSignature
+		}
+
+		mu.Lock()
+		if now.Sub(lastSweep) >= maxSkew {
+			lastSweep = now
+			for nonce, expiry := range seen {
+				if now.After(expiry) {
+					delete(seen, nonce)
+				}
+			}
+		}
+		nonce := parts[0] + ":" + parts[2]
+		_, replayed := seen[nonce]
+		if !replayed {
+			seen[nonce] = signed.Add(maxSkew)
+		}
+		mu.Unlock()
+		if replayed {
+			return nil, errors.New("signature replayed")
+		}
+
+		id := &Identity{Name: parts[0]}
+		if known, ok := ids[parts[0]]; ok {
+			copied := *known
+			id = &copied
+		}
+		id.Via = "hmac"
+		return id, nil
+	})
+}
+
+// SignHMAC returns the header value a client sends HMACAuthenticator for the
+// call of method with seqId, with a fresh nonce. Each call needs its own.
+func SignHMAC(keyID string, key []byte, method string, seqId int32, t time.Time) string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("thrifttools: reading a nonce: " + err.Error())
+	}
+	unix, nonce := strconv.FormatInt(t.Unix(), 10), hex.EncodeToString(b[:])
+	return keyID + ":" + unix + ":" + nonce + ":" + signHMAC(key, keyID, unix, nonce, seqId, method)
+}
+
+func signHMAC(key []byte, keyID, unix, nonce string, seqId int32, method string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyID + "\n" + unix + "\n" + nonce + "\n" + strconv.FormatInt(int64(seqId), 10) + "\n" + method))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ACLRule allows Principals to call the methods matching the path.Match
+// patterns of Methods. A principal is a caller name, "role:" and a role,
+// or "*" for any authenticated caller.
+type ACLRule struct {
+	Methods    []string
+	Principals []string
+}
+
+// ACL allows a call if a rule matching the method allows the caller. Methods
+// no rule matches are allowed only with DefaultAllow.
+type ACL struct {
+	Rules        []ACLRule
+	DefaultAllow bool
+}
+
+func (a *ACL) Allowed(id *Identity, method string) bool {
+	matched := false
+	for _, rule := range a.Rules {
+		if !matchAny(rule.Methods, method) {
+			continue
+		}
+		matched = true
+		if id != nil && rule.allows(id) {
+			return true
+		}
+	}
+	return !matched && a.DefaultAllow
+}
+
+func (r ACLRule) allows(id *Identity) bool {
+	for _, p := range r.Principals {
+		if p == "*" || p == id.Name {
+			return true
+		}
+		if role := strings.TrimPrefix(p, "role:"); role != p {
+			for _, has := range id.Roles {
+				if has == role {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type AuthOptions struct {
+	//tried in order, the first identifying the caller wins
+	Authenticators []Authenticator
+	//let callers without credentials through to the ACL
+	AllowAnonymous bool
+	//nil allows every authenticated caller
+	ACL *ACL
+}
+
+// Auth authenticates the caller, stores its Identity in the Context under
+// IdentityKey and checks the ACL, aborting rejected calls with an
+// AuthError.
+func Auth(opts AuthOptions) HandlerFunc {
+	return func(c *Context) {
+		var id *Identity
+		for _, a := range opts.Authenticators {
+			var err error
+			if id, err = a.Authenticate(c); err != nil {
+				c.AbortWithError(&AuthError{Method: c.Name, Reason: err.Error()})
+				return
+			}
+			if id != nil {
+				break
+			}
+		}
+		if id == nil && !opts.AllowAnonymous {
+			c.AbortWithError(&AuthError{Method: c.Name, Reason: "no credentials"})
+			return
+		}
+		if id != nil {
+			c.Set(IdentityKey, id)
+		}
+		if opts.ACL != nil && !opts.ACL.Allowed(id, c.Name) {
+			name := "anonymous caller"
+			if id != nil {
+				name = id.Name
+			}
+			c.AbortWithError(&AuthError{Method: c.Name, Denied: true, Reason: name + " is not allowed"})
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package thrifttools
+
+import (
+	"testing"
+	"time"
+)
+
+// authCall returns the Context of a call of name with seqId carrying the
+// THeader headers.
+func authCall(name string, seqId int32, headers map[string]string) *Context {
+	return &Context{Name: name, SeqId: seqId, requestHeaders: headers}
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	key := []byte("secret")
+	auth := HMACAuthenticator("sig", map[string][]byte{"k1": key}, map[string]*Identity{"k1": {Name: "billing", Roles: []string{"admin"}}}, time.Minute)
+	now := time.Now()
+	call := func(name string, seqId int32, sig string) (*Identity, error) {
+		return auth.Authenticate(authCall(name, seqId, map[string]string{"sig": sig}))
+	}
+
+	sig := SignHMAC("k1", key, "Echo", 5, now)
+	if id, err := call("Echo", 5, sig); err != nil || id.Name != "billing" || id.Via != "hmac" {
+		t.Fatal(id, err)
+	}
+	if _, err := call("Echo", 5, sig); err == nil {
+		t.Fatal("replayed nonce accepted")
+	}
+	cases := map[string]struct {
+		name  string
+		seqId int32
+		sig   string
+	}{
+		"expired":     {"Echo", 5, SignHMAC("k1", key, "Echo", 5, now.Add(-2*time.Minute))},
+		"future":      {"Echo", 5, SignHMAC("k1", key, "Echo", 5, now.Add(2*time.Minute))},
+		"seqid":       {"Echo", 6, SignHMAC("k1", key, "Echo", 5, now)},
+		"method":      {"Delete", 5, SignHMAC("k1", key, "Echo", 5, now)},
+		"wrong key":   {"Echo", 5, SignHMAC("k1", []byte("guess"), "Echo", 5, now)},
+		"unknown key": {"Echo", 5, SignHMAC("k2", key, "Echo", 5, now)},
+		"malformed":   {"Echo", 5, "k1:0"},
+	}
+	for name, tc := range cases {
+		if id, err := call(tc.name, tc.seqId, tc.sig); err == nil {
+			t.Fatal(name, "accepted", id)
+		}
+	}
+	if id, err := auth.Authenticate(authCall("Echo", 5, nil)); id != nil || err != nil {
+		t.Fatal("without the header", id, err)
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	ops := &Identity{Name: "ops"}
+	auth := TokenAuthenticator("token", map[string]*Identity{"t0k3n": ops})
+	if id, err := auth.Authenticate(authCall("Echo", 1, map[string]string{"token": "Bearer t0k3n"})); err != nil || id.Name != "ops" || id.Via != "token" {
+		t.Fatal(id, err)
+	}
+	if ops.Via != "" {
+		t.Fatal("identity of the token map changed")
+	}
+	for _, token := range []string{"t0k3", "t0k3n2", ""} {
+		if id, err := auth.Authenticate(authCall("Echo", 1, map[string]string{"token": token})); err != errBadToken {
+			t.Fatal(token, id, err)
+		}
+	}
+	if id, err := auth.Authenticate(authCall("Echo", 1, nil)); id != nil || err != nil {
+		t.Fatal("without the header", id, err)
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl := &ACL{Rules: []ACLRule{
+		{Methods: []string{"Get*"}, Principals: []string{"*"}},
+		{Methods: []string{"Delete"}, Principals: []string{"role:admin"}},
+		{Methods: []string{"Reset"}, Principals: []string{"ops"}},
+	}}
+	admin := &Identity{Name: "alice", Roles: []string{"admin"}}
+	roleOps := &Identity{Name: "bob", Roles: []string{"ops"}}
+	ops := &Identity{Name: "ops"}
+	cases := []struct {
+		id      *Identity
+		method  string
+		allowed bool
+	}{
+		{roleOps, "GetUser", true},
+		{nil, "GetUser", false},
+		{admin, "Delete", true},
+		{roleOps, "Delete", false},
+		{ops, "Reset", true},
+		//a role does not match a caller name
+		{roleOps, "Reset", false},
+		{admin, "Unlisted", false},
+	}
+	for _, tc := range cases {
+		if allowed := acl.Allowed(tc.id, tc.method); allowed != tc.allowed {
+			t.Fatal(tc.id, tc.method, allowed)
+		}
+	}
+
+	acl.DefaultAllow = true
+	if !acl.Allowed(admin, "Unlisted") || !acl.Allowed(nil, "Unlisted") {
+		t.Fatal("DefaultAllow denied a method no rule matches")
+	}
+	if acl.Allowed(roleOps, "Delete") {
+		t.Fatal("DefaultAllow allowed a method a rule matches")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	auth := Auth(AuthOptions{
+		Authenticators: []Authenticator{TokenAuthenticator("token", map[string]*Identity{"t0k3n": {Name: "ops"}})},
+		ACL:            &ACL{Rules: []ACLRule{{Methods: []string{"Reset"}, Principals: []string{"ops"}}}},
+	})
+	cases := []struct {
+		method  string
+		headers map[string]string
+		typeId  int32
+	}{
+		{"Reset", map[string]string{"token": "t0k3n"}, 0},
+		{"Reset", nil, ExceptionUnauthenticated},
+		{"Reset", map[string]string{"token": "guess"}, ExceptionUnauthenticated},
+		{"Delete", map[string]string{"token": "t0k3n"}, ExceptionPermissionDenied},
+	}
+	for _, tc := range cases {
+		c := authCall(tc.method, 1, tc.headers)
+		auth(c)
+		var typeId int32
+		if err, ok := c.Err.(*AuthError); ok {
+			typeId = err.TypeId()
+		} else if c.Err != nil {
+			t.Fatal(c.Err)
+		}
+		if typeId != tc.typeId {
+			t.Fatal(tc.method, tc.headers, typeId)
+		}
+		if id := IdentityOf(c); tc.typeId != ExceptionUnauthenticated && (id == nil || id.Name != "ops") {
+			t.Fatal("identity", id)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package thrifttools
+
+import (
+	"sync"
+	"time"
+)
+
+// ExceptionOverloaded is the TApplicationException type id clients get for
+// calls rejected by a Bulkhead.
+const ExceptionOverloaded int32 = 101
+
+// OverloadError aborts the calls a Bulkhead has no room for.
+type OverloadError struct {
+	Method string
+	//the call waited in the queue for QueueTimeout
+	Timeout bool
+}
+
+func (e *OverloadError) Error() string {
+	if e.Timeout {
+		return "timed out waiting to call " + e.Method
+	}
+	return "too many calls to " + e.Method
+}
+
+func (e *OverloadError) TypeId() int32 {
+	return ExceptionOverloaded
+}
+
+// Bulkhead caps the calls in flight through its middleware at
+// MaxConcurrent, so one slow method cannot take every goroutine of the
+// server. Up to MaxQueue more calls wait up to QueueTimeout, or until the
+// call context is done, for a slot; the others are rejected with an
+// OverloadError. Use it on a method or a group, e.g.
+//
+//	midware.Group("reports", "Export*").Use(NewBulkhead(8, 16, time.Second).Middleware())
+//
+// where the methods of the group share the slots, or set PerMethod to give
+// each method its own.
+type Bulkhead struct {
+	MaxConcurrent int
+	MaxQueue      int
+	//no timeout if zero
+	QueueTimeout time.Duration
+	PerMethod    bool
+
+	mu           sync.Mutex
+	compartments map[string]*compartment
+}
+
+type compartment struct {
+	slots  chan struct{}
+	queued int
+}
+
+func NewBulkhead(maxConcurrent, maxQueue int, queueTimeout time.Duration) *Bulkhead {
+	return &Bulkhead{MaxConcurrent: maxConcurrent, MaxQueue: maxQueue, QueueTimeout: queueTimeout}
+}
+
+func (b *Bulkhead) compartment(method string) *compartment {
+	if !b.PerMethod {
+		method = ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.compartments == nil {
+		b.compartments = make(map[string]*compartment)
+	}
+	cp, ok := b.compartments[method]
+	if !ok {
+		cp = &compartment{slots: make(chan struct{}, b.MaxConcurrent)}
+		b.compartments[method] = cp
+	}
+	return cp
+}
+
+func (b *Bulkhead) Middleware() HandlerFunc {
+	return func(c *Context) {
+		cp := b.compartment(c.Name)
+		if err := b.acquire(c, cp); err != nil {
+			c.AbortWithError(err)
+			return
+		}
+		defer func() { <-cp.slots }()
+		c.Next()
+	}
+}
+
+func (b *Bulkhead) acquire(c *Context, cp *compartment) error {
+	select {
+	case cp.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	b.mu.Lock()
+	if cp.queued >= b.MaxQueue {
+		b.mu.Unlock()
+		return &OverloadError{Method: c.Name}
+	}
+	cp.queued += 1
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		cp.queued -= 1
+		b.mu.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if b.QueueTimeout > 0 {
+		timer := time.NewTimer(b.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case cp.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return &OverloadError{Method: c.Name, Timeout: true}
+	case <-c.Context().Done():
+		return c.Context().Err()
+	}
+}
+
+// InFlight returns the calls holding a slot of the compartment of method,
+// the only compartment unless PerMethod.
+func (b *Bulkhead) InFlight(method string) int {
+	return len(b.compartment(method).slots)
+}
+
+// Queued returns the calls waiting for a slot of the compartment of method.
+func (b *Bulkhead) Queued(method string) int {
+	cp := b.compartment(method)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return cp.queued
+}
@@ -0,0 +1,390 @@
+package thrifttools
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNoEndpoint = errors.New("no endpoint available")
+
+type Endpoint struct {
+	Addr string
+	Pool *Pool
+
+	cluster *Cluster
+	//added or back from ejection, for slow start
+	since     time.Time
+	ejected   bool
+	ejectedAt time.Time
+	ejections int
+	//stats at the previous sweep
+	requests int64
+	errors   int64
+}
+
+// Ejected reports whether outlier detection currently keeps the endpoint
+// out of the balancer.
+func (e *Endpoint) Ejected() bool {
+	e.cluster.mu.Lock()
+	ejected := e.ejected
+	e.cluster.mu.Unlock()
+	return ejected
+}
+
+// Cluster balances calls over one Pool per backend endpoint, picking the
+// endpoint with the fewest connections in use.
+type Cluster struct {
+	NewPool func(addr string) *Pool
+	//virtual nodes per endpoint on the GetForKey hash ring
+	Replicas  int
+	SlowStart *SlowStart
+
+	mu        sync.Mutex
+	endpoints []*Endpoint
+	ring      *hashRing
+	outlier   *OutlierDetection
+	stop      chan struct{}
+}
+
+func NewCluster(newPool func(addr string) *Pool, addrs ...string) *Cluster {
+	c := &Cluster{NewPool: newPool}
+	for _, addr := range addrs {
+		c.add(addr, time.Time{})
+	}
+	return c
+}
+
+// Add starts balancing over addr, in slow start if the cluster has one.
+func (c *Cluster) Add(addr string) {
+	c.add(addr, nowFun())
+}
+
+func (c *Cluster) add(addr string, since time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.endpoints {
+		if e.Addr == addr {
+			return
+		}
+	}
+	c.endpoints = append(c.endpoints, &Endpoint{Addr: addr, Pool: c.NewPool(addr), cluster: c, since: since})
+	c.ring = nil
+}
+
+func (c *Cluster) Remove(addr string) {
+	c.mu.Lock()
+	var removed *Endpoint
+	for i, e := range c.endpoints {
+		if e.Addr == addr {
+			removed = e
+			c.endpoints = append(c.endpoints[:i:i], c.endpoints[i+1:]...)
+			c.ring = nil
+			break
+		}
+	}
+	c.mu.Unlock()
+	if removed != nil {
+		removed.Pool.Close()
+	}
+}
+
+func (c *Cluster) Endpoints() []*Endpoint {
+	c.mu.Lock()
+	endpoints := append([]*Endpoint(nil), c.endpoints...)
+	c.mu.Unlock()
+	return endpoints
+}
+
+// healthy returns the endpoints not ejected, or all of them when every
+// endpoint is ejected. It is called with c.mu held.
+func (c *Cluster) healthy() []*Endpoint {
+	endpoints := make([]*Endpoint, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		if !e.ejected {
+			endpoints = append(endpoints, e)
+		}
+	}
+	if len(endpoints) == 0 {
+		return append(endpoints, c.endpoints...)
+	}
+	return endpoints
+}
+
+// SlowStart ramps the selection weight of an endpoint that was just added or
+// came back from ejection from MinWeight up to 1 over Window, linearly or,
+// with Exponential, doubling at a steady rate.
+type SlowStart struct {
+	Window      time.Duration
+	MinWeight   float64
+	Exponential bool
+}
+
+func (s *SlowStart) weight(elapsed time.Duration) float64 {
+	if s == nil || s.Window <= 0 || elapsed >= s.Window {
+		return 1
+	}
+	min := s.MinWeight
+	if min <= 0 || min > 1 {
+		min = 0.1
+	}
+	f := float64(elapsed) / float64(s.Window)
+	if f < 0 {
+		f = 0
+	}
+	if s.Exponential {
+		return min * math.Pow(1/min, f)
+	}
+	return min + (1-min)*f
+}
+
+// pick returns the endpoint with the fewest connections in use relative to
+// its slow start weight.
+func (c *Cluster) pick() *Endpoint {
+	c.mu.Lock()
+	endpoints := c.healthy()
+	now := nowFun()
+	weights := make([]float64, len(endpoints))
+	for i, e := range endpoints {
+		weights[i] = c.SlowStart.weight(now.Sub(e.since))
+	}
+	c.mu.Unlock()
+	var best *Endpoint
+	least := 0.0
+	for i, e := range endpoints {
+		if n := float64(e.Pool.inUse()+1) / weights[i]; best == nil || n < least {
+			best, least = e, n
+		}
+	}
+	return best
+}
+
+// Get borrows a connection from the least loaded endpoint. Return it with
+// Release on the endpoint pool so its stats feed outlier detection.
+func (c *Cluster) Get(ctx context.Context) (interface{}, *Endpoint, error) {
+	e := c.pick()
+	if e == nil {
+		return nil, nil, ErrNoEndpoint
+	}
+	conn, err := e.Pool.GetWithPriority(ctx, PriorityNormal)
+	return conn, e, err
+}
+
+// GetForKey borrows a connection from the endpoint key hashes to, so calls
+// for the same key keep reaching the same backend. While that endpoint is
+// ejected its keys go to the next endpoint on the ring.
+func (c *Cluster) GetForKey(ctx context.Context, key string) (interface{}, *Endpoint, error) {
+	c.mu.Lock()
+	if c.ring == nil {
+		c.ring = newHashRing(c.endpoints, c.Replicas)
+	}
+	up := false
+	for _, e := range c.endpoints {
+		up = up || !e.ejected
+	}
+	e := c.ring.get(key, func(e *Endpoint) bool { return !up || !e.ejected })
+	c.mu.Unlock()
+	if e == nil {
+		return nil, nil, ErrNoEndpoint
+	}
+	conn, err := e.Pool.GetWithPriority(ctx, PriorityNormal)
+	return conn, e, err
+}
+
+func (c *Cluster) Do(ctx context.Context, fn func(conn interface{}) error) error {
+	e := c.pick()
+	if e == nil {
+		return ErrNoEndpoint
+	}
+	return e.Pool.Do(ctx, fn)
+}
+
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	endpoints := c.endpoints
+	c.endpoints = nil
+	c.ring = nil
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.mu.Unlock()
+	for _, e := range endpoints {
+		e.Pool.Close()
+	}
+	return nil
+}
+
+// OutlierDetection ejects endpoints whose error rate or p99 latency is far
+// worse than the rest of the cluster. An ejected endpoint comes back after
+// BaseEjectionTime doubled for every previous ejection, up to
+// MaxEjectionTime, or without a cap when it is 0. At most
+// MaxEjectionPercent of the endpoints are ejected at once, though a single
+// endpoint may always be.
+type OutlierDetection struct {
+	//time between sweeps, that of NewOutlierDetection when not positive
+	Interval           time.Duration
+	BaseEjectionTime   time.Duration
+	MaxEjectionTime    time.Duration
+	MaxEjectionPercent int
+	//endpoints need MinRequests calls in an interval to be judged, and at
+	//least MinHosts of them to compute the cluster baseline
+	MinRequests int64
+	MinHosts    int
+	//eject when the error rate exceeds the mean of the other endpoints by
+	//ErrorStdevFactor standard deviations and by at least ErrorRateGap, or
+	//the p99 latency is LatencyFactor times their median p99
+	ErrorStdevFactor float64
+	ErrorRateGap     float64
+	LatencyFactor    float64
+}
+
+func NewOutlierDetection() *OutlierDetection {
+	return &OutlierDetection{
+		Interval:           10 * time.Second,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionTime:    300 * time.Second,
+		MaxEjectionPercent: 10,
+		MinRequests:        100,
+		MinHosts:           3,
+		ErrorStdevFactor:   1.9,
+		ErrorRateGap:       0.1,
+		LatencyFactor:      3,
+	}
+}
+
+// DetectOutliers starts sweeping the endpoints every od.Interval until the
+// cluster is closed.
+func (c *Cluster) DetectOutliers(od *OutlierDetection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outlier = od
+	if c.stop != nil {
+		close(c.stop)
+	}
+	c.stop = make(chan struct{})
+	interval := od.Interval
+	if interval <= 0 {
+		interval = NewOutlierDetection().Interval
+	}
+	go c.detect(interval, c.stop)
+}
+
+func (c *Cluster) detect(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Sweep()
+		case <-stop:
+			return
+		}
+	}
+}
+
+type endpointSample struct {
+	e         *Endpoint
+	errorRate float64
+	p99       time.Duration
+}
+
+// Sweep runs one round of outlier detection.
+func (c *Cluster) Sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	od := c.outlier
+	if od == nil {
+		return
+	}
+	now := nowFun()
+	ejected := 0
+	samples := make([]endpointSample, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		stats := e.Pool.Stats()
+		requests, errs := stats.Requests-e.requests, stats.Errors-e.errors
+		e.requests, e.errors = stats.Requests, stats.Errors
+		//judge the p99 of this interval only
+		e.Pool.resetLatencies()
+		if e.ejected {
+			if now.Before(e.ejectedAt.Add(od.ejectionTime(e.ejections))) {
+				ejected += 1
+				continue
+			}
+			e.ejected = false
+			e.since = now
+			continue
+		}
+		if requests < od.MinRequests || requests == 0 {
+			continue
+		}
+		samples = append(samples, endpointSample{e, float64(errs) / float64(requests), stats.P99})
+	}
+	if len(samples) < od.MinHosts || len(samples) < 2 {
+		c.decay(samples)
+		return
+	}
+
+	healthy := make([]endpointSample, 0, len(samples))
+	for i, s := range samples {
+		if !od.outlier(samples, i) || (ejected > 0 && (ejected+1)*100 > len(c.endpoints)*od.MaxEjectionPercent) {
+			healthy = append(healthy, s)
+			continue
+		}
+		s.e.ejected = true
+		s.e.ejectedAt = now
+		s.e.ejections += 1
+		ejected += 1
+	}
+	c.decay(healthy)
+}
+
+// outlier compares samples[i] against the other endpoints.
+func (od *OutlierDetection) outlier(samples []endpointSample, i int) bool {
+	n := float64(len(samples) - 1)
+	var mean, stdev float64
+	p99s := make([]time.Duration, 0, len(samples)-1)
+	for j, s := range samples {
+		if j != i {
+			mean += s.errorRate
+			p99s = append(p99s, s.p99)
+		}
+	}
+	mean /= n
+	for j, s := range samples {
+		if j != i {
+			stdev += (s.errorRate - mean) * (s.errorRate - mean)
+		}
+	}
+	stdev = math.Sqrt(stdev / n)
+	if samples[i].errorRate-mean > math.Max(od.ErrorStdevFactor*stdev, od.ErrorRateGap) {
+		return true
+	}
+	sort.Slice(p99s, func(a, b int) bool { return p99s[a] < p99s[b] })
+	median := p99s[len(p99s)/2]
+	return od.LatencyFactor > 0 && median > 0 && float64(samples[i].p99) > od.LatencyFactor*float64(median)
+}
+
+// decay forgets one past ejection of every endpoint that looked healthy in
+// this sweep, so the ejection time shrinks back over time.
+func (c *Cluster) decay(samples []endpointSample) {
+	for _, s := range samples {
+		if s.e.ejections > 0 {
+			s.e.ejections -= 1
+		}
+	}
+}
+
+func (od *OutlierDetection) ejectionTime(ejections int) time.Duration {
+	d := od.BaseEjectionTime
+	for i := 1; i < ejections && (od.MaxEjectionTime <= 0 || d < od.MaxEjectionTime) && d < math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if od.MaxEjectionTime > 0 && d > od.MaxEjectionTime {
+		d = od.MaxEjectionTime
+	}
+	return d
+}
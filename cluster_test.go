@@ -0,0 +1,32 @@
+package thrifttools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEjectionTime(t *testing.T) {
+	od := &OutlierDetection{BaseEjectionTime: time.Second}
+	for ejections, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if d := od.ejectionTime(ejections); d != want {
+			t.Fatal("uncapped", ejections, d)
+		}
+	}
+	if d := od.ejectionTime(1000); d <= 0 {
+		t.Fatal("overflow", d)
+	}
+	od.MaxEjectionTime = 3 * time.Second
+	if d := od.ejectionTime(4); d != 3*time.Second {
+		t.Fatal("capped", d)
+	}
+}
+
+func TestDetectOutliersDefaultInterval(t *testing.T) {
+	newPool := func(addr string) *Pool {
+		return NewPool(func() (interface{}, error) { return addr, nil }, func(interface{}) error { return nil }, 1)
+	}
+	c := NewCluster(newPool, "a", "b")
+	c.DetectOutliers(&OutlierDetection{})
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+}
@@ -0,0 +1,433 @@
+// Command thrifttools-gen generates a static processor for a thrift service
+// from the Go code the thrift compiler generated for it. The processor
+// decodes the *Args and encodes the *Result structs of each method and calls
+// the handler without reflection, and plugs into thrifttools.ThriftMidWare so
+// the same HandlerFunc chain and Context run around every call:
+//
+//	thrifttools-gen -service Calculator -dir gen-go/tutorial
+//
+// writes gen-go/tutorial/calculator_thrifttools.go with
+//
+//	func NewCalculatorMidWare(handler Calculator) *thrifttools.ThriftMidWare
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+var (
+	service   = flag.String("service", "", "name of the service interface")
+	dir       = flag.String("dir", ".", "directory of the thrift generated package")
+	out       = flag.String("out", "", "output file, default <service>_thrifttools.go in -dir")
+	toolsPath = flag.String("thrifttools", "github.com/the-no/thrifttools", "import path of thrifttools")
+)
+
+type method struct {
+	Name     string
+	Wire     string
+	Service  string
+	Context  bool
+	Args     []string
+	Return   bool
+	Success  string
+	Result   bool
+	Excs     []exception
+	NewArgs  bool
+	CallType string
+}
+
+type exception struct {
+	Field string
+	Type  string
+	Id    int64
+}
+
+type pkg struct {
+	name       string
+	thriftPath string
+	types      map[string]*ast.TypeSpec
+	funcs      map[string]bool
+	wires      map[string]string
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("thrifttools-gen: ")
+	flag.Parse()
+	if *service == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	output := *out
+	if output == "" {
+		output = filepath.Join(*dir, strings.ToLower(*service)+"_thrifttools.go")
+	}
+
+	p, err := parse(*dir, output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	methods, err := p.methods(*service)
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := generate(p, *service, methods)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func parse(dir, output string) (*pkg, error) {
+	fset := token.NewFileSet()
+	skip := func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != filepath.Base(output)
+	}
+	pkgs, err := parser.ParseDir(fset, dir, skip, 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &pkg{
+		thriftPath: "git.apache.org/thrift.git/lib/go/thrift",
+		types:      make(map[string]*ast.TypeSpec),
+		funcs:      make(map[string]bool),
+		wires:      make(map[string]string),
+	}
+	for name, astPkg := range pkgs {
+		if strings.HasSuffix(name, "_test") || name == "main" {
+			continue
+		}
+		p.name = name
+		for _, f := range astPkg.Files {
+			p.collect(f)
+		}
+	}
+	if p.name == "" {
+		return nil, fmt.Errorf("no thrift package in %s", dir)
+	}
+	return p, nil
+}
+
+func (p *pkg) collect(f *ast.File) {
+	for _, imp := range f.Imports {
+		if path, _ := strconv.Unquote(imp.Path.Value); strings.HasSuffix(path, "/lib/go/thrift") {
+			p.thriftPath = path
+		}
+	}
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				if ts, ok := spec.(*ast.TypeSpec); ok {
+					p.types[ts.Name.Name] = ts
+				}
+			}
+		case *ast.FuncDecl:
+			if decl.Recv != nil {
+				continue
+			}
+			p.funcs[decl.Name.Name] = true
+			if strings.HasPrefix(decl.Name.Name, "New") && strings.HasSuffix(decl.Name.Name, "Processor") {
+				p.collectWires(decl)
+			}
+		}
+	}
+}
+
+// collectWires finds the thrift method names in the generated processor
+// constructor, p.processorMap["add"] = &calculatorProcessorAdd{...}.
+func (p *pkg) collectWires(fn *ast.FuncDecl) {
+	ast.Inspect(fn, func(n ast.Node) bool {
+		assign, ok := n.(*ast.AssignStmt)
+		if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+			return true
+		}
+		index, ok := assign.Lhs[0].(*ast.IndexExpr)
+		if !ok {
+			return true
+		}
+		key, ok := index.Index.(*ast.BasicLit)
+		if !ok || key.Kind != token.STRING {
+			return true
+		}
+		unary, ok := assign.Rhs[0].(*ast.UnaryExpr)
+		if !ok {
+			return true
+		}
+		lit, ok := unary.X.(*ast.CompositeLit)
+		if !ok {
+			return true
+		}
+		if ident, ok := lit.Type.(*ast.Ident); ok {
+			p.wires[ident.Name], _ = strconv.Unquote(key.Value)
+		}
+		return true
+	})
+}
+
+func (p *pkg) methods(svc string) ([]method, error) {
+	ts, ok := p.types[svc]
+	if !ok {
+		return nil, fmt.Errorf("service interface %s not found", svc)
+	}
+	iface, ok := ts.Type.(*ast.InterfaceType)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an interface", svc)
+	}
+	var methods []method
+	for _, field := range iface.Methods.List {
+		switch typ := field.Type.(type) {
+		case *ast.Ident:
+			//embedded service this one extends
+			parent, err := p.methods(typ.Name)
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods, parent...)
+		case *ast.FuncType:
+			m, err := p.method(svc, field.Names[0].Name, typ)
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods, m)
+		default:
+			log.Printf("skipping %s embedded in %s, only services of the same package are supported", expr(field.Type), svc)
+		}
+	}
+	return methods, nil
+}
+
+func (p *pkg) method(svc, name string, fn *ast.FuncType) (method, error) {
+	m := method{
+		Name:     name,
+		Wire:     name,
+		Service:  svc,
+		Return:   fn.Results != nil && fieldCount(fn.Results) > 1,
+		NewArgs:  p.funcs["New"+svc+name+"Args"],
+		CallType: lowerFirst(svc) + name + "StaticCall",
+	}
+	if wire, ok := p.wires[lowerFirst(svc)+"Processor"+name]; ok {
+		m.Wire = wire
+	}
+
+	params := fieldCount(fn.Params)
+	//newer thrift compilers pass a context.Context first
+	if params > 0 && expr(fn.Params.List[0].Type) == "context.Context" {
+		m.Context = true
+		params -= 1
+	}
+	args, err := p.structFields(svc + name + "Args")
+	if err != nil {
+		return m, err
+	}
+	if len(args) != params {
+		return m, fmt.Errorf("%s%sArgs does not match the parameters of %s.%s", svc, name, svc, name)
+	}
+	for _, f := range args {
+		m.Args = append(m.Args, f.Names[0].Name)
+	}
+
+	//oneway methods have no result struct
+	if _, ok := p.types[svc+name+"Result"]; !ok {
+		return m, nil
+	}
+	m.Result = true
+	results, err := p.structFields(svc + name + "Result")
+	if err != nil {
+		return m, err
+	}
+	for _, f := range results {
+		if f.Names[0].Name == "Success" {
+			m.Success = "r"
+			if ret := expr(fn.Results.List[0].Type); expr(f.Type) == "*"+ret {
+				m.Success = "&r"
+			}
+			continue
+		}
+		id, err := tagId(f)
+		if err != nil {
+			return m, fmt.Errorf("%s%sResult.%s: %v", svc, name, f.Names[0].Name, err)
+		}
+		m.Excs = append(m.Excs, exception{Field: f.Names[0].Name, Type: expr(f.Type), Id: id})
+	}
+	return m, nil
+}
+
+// tagId returns the field id in the thrift tag of f.
+func tagId(f *ast.Field) (int64, error) {
+	if f.Tag == nil {
+		return 0, fmt.Errorf("no thrift tag")
+	}
+	tag, err := strconv.Unquote(f.Tag.Value)
+	if err != nil {
+		return 0, err
+	}
+	parts := strings.Split(reflect.StructTag(tag).Get("thrift"), ",")
+	if len(parts) < 2 {
+		return 0, fmt.Errorf("no field id in tag %s", tag)
+	}
+	return strconv.ParseInt(parts[1], 10, 16)
+}
+
+// structFields returns the fields of a struct, one name each.
+func (p *pkg) structFields(name string) ([]*ast.Field, error) {
+	ts, ok := p.types[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a struct", name)
+	}
+	var fields []*ast.Field
+	for _, f := range st.Fields.List {
+		for _, n := range f.Names {
+			fields = append(fields, &ast.Field{Names: []*ast.Ident{n}, Type: f.Type, Tag: f.Tag})
+		}
+	}
+	return fields, nil
+}
+
+func fieldCount(fl *ast.FieldList) int {
+	if fl == nil {
+		return 0
+	}
+	n := 0
+	for _, f := range fl.List {
+		if len(f.Names) == 0 {
+			n += 1
+		}
+		n += len(f.Names)
+	}
+	return n
+}
+
+func expr(e ast.Expr) string {
+	var buf bytes.Buffer
+	format.Node(&buf, token.NewFileSet(), e)
+	return buf.String()
+}
+
+func lowerFirst(s string) string {
+	for i, r := range s {
+		return string(unicode.ToLower(r)) + s[i+len(string(r)):]
+	}
+	return s
+}
+
+var tmpl = template.Must(template.New("processor").Parse(`// Code generated by thrifttools-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	thrift "{{.ThriftPath}}"
+	"{{.ToolsPath}}"
+)
+
+// New{{.Service}}MidWare returns a ThriftMidWare serving handler through
+// generated calls instead of reflection.
+func New{{.Service}}MidWare(handler {{.Service}}) *thrifttools.ThriftMidWare {
+	return thrifttools.NewStaticMidWare(handler, map[string]func() thrifttools.StaticCall{
+{{- range .Methods}}
+		"{{.Wire}}": func() thrifttools.StaticCall { return &{{.CallType}}{handler: handler} },
+{{- end}}
+	})
+}
+{{range .Methods}}
+type {{.CallType}} struct {
+	handler  {{$.Service}}
+	args     *{{.Service}}{{.Name}}Args
+{{- if .Result}}
+	result   {{.Service}}{{.Name}}Result
+{{- end}}
+	err      error
+	declared bool
+}
+
+func (p *{{.CallType}}) Read(iprot thrift.TProtocol) error {
+{{- if .NewArgs}}
+	p.args = New{{.Service}}{{.Name}}Args()
+{{- else}}
+	p.args = &{{.Service}}{{.Name}}Args{}
+{{- end}}
+	return p.args.Read(iprot)
+}
+
+func (p *{{.CallType}}) Call(c *thrifttools.Context) {
+	{{if .Return}}r, {{end}}err := p.handler.{{.Name}}({{if .Context}}c.Context(){{if .Args}}, {{end}}{{end}}{{range $i, $a := .Args}}{{if $i}}, {{end}}p.args.{{$a}}{{end}})
+	p.err = err
+{{- if .Success}}
+	if err == nil {
+		p.result.Success = {{.Success}}
+	}
+{{- end}}
+{{- range .Excs}}
+	if v, ok := err.({{.Type}}); ok {
+		p.result.{{.Field}} = v
+		p.declared = true
+	}
+{{- end}}
+}
+
+func (p *{{.CallType}}) Err() (error, bool) {
+	return p.err, p.declared
+}
+{{- if .Excs}}
+
+func (p *{{.CallType}}) ExceptionId(x error) (int16, bool) {
+	switch x.(type) {
+{{- range .Excs}}
+	case {{.Type}}:
+		return {{.Id}}, true
+{{- end}}
+	}
+	return 0, false
+}
+{{- end}}
+
+func (p *{{.CallType}}) Write(oprot thrift.TProtocol) error {
+{{- if .Result}}
+	return p.result.Write(oprot)
+{{- else}}
+	return nil
+{{- end}}
+}
+{{end}}`))
+
+func generate(p *pkg, service string, methods []method) ([]byte, error) {
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Wire < methods[j].Wire })
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, map[string]interface{}{
+		"Package":    p.name,
+		"ThriftPath": p.thriftPath,
+		"ToolsPath":  *toolsPath,
+		"Service":    service,
+		"Methods":    methods,
+	})
+	if err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %v", err)
+	}
+	return src, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func TestGenerateGolden(t *testing.T) {
+	dir := filepath.Join("testdata", "tutorial")
+	p, err := parse(dir, filepath.Join(dir, "calculator_thrifttools.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods, err := p.methods("Calculator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generate(p, "Calculator", methods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join(dir, "calculator_thrifttools.go.golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, want) {
+		t.Fatalf("generated code differs from %s, run go test -update if the change is intended:\n%s", golden, src)
+	}
+}
@@ -0,0 +1,254 @@
+package tutorial
+
+import (
+	"fmt"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+type SharedService interface {
+	GetStruct(key int32) (r *SharedStruct, err error)
+}
+
+type Calculator interface {
+	SharedService
+	Ping() (err error)
+	Add(num1 int32, num2 int32) (r int32, err error)
+	Calculate(logid int32, w *Work) (r int32, err error)
+	Tags(n int32) (r []string, err error)
+	Zip() (err error)
+}
+
+type SharedStruct struct {
+	Key int32 `thrift:"key,1" json:"key"`
+}
+
+func (p *SharedStruct) Read(iprot thrift.TProtocol) error {
+	return readI32s(iprot, map[int16]*int32{1: &p.Key})
+}
+func (p *SharedStruct) Write(oprot thrift.TProtocol) error {
+	return writeI32s(oprot, map[int16]int32{1: p.Key})
+}
+
+type Work struct {
+	Num1 int32 `thrift:"num1,1" json:"num1"`
+}
+
+func (p *Work) Read(iprot thrift.TProtocol) error {
+	return readI32s(iprot, map[int16]*int32{1: &p.Num1})
+}
+func (p *Work) Write(oprot thrift.TProtocol) error {
+	return writeI32s(oprot, map[int16]int32{1: p.Num1})
+}
+
+type InvalidOperation struct {
+	What int32 `thrift:"what,1" json:"what"`
+}
+
+func (p *InvalidOperation) Read(iprot thrift.TProtocol) error {
+	return readI32s(iprot, map[int16]*int32{1: &p.What})
+}
+func (p *InvalidOperation) Write(oprot thrift.TProtocol) error {
+	return writeI32s(oprot, map[int16]int32{1: p.What})
+}
+func (p *InvalidOperation) Error() string { return fmt.Sprint("what ", p.What) }
+
+func readI32s(iprot thrift.TProtocol, fs map[int16]*int32) error {
+	iprot.ReadStructBegin()
+	for {
+		_, t, id, err := iprot.ReadFieldBegin()
+		if err != nil {
+			return err
+		}
+		if t == thrift.STOP {
+			break
+		}
+		if f, ok := fs[id]; ok && t == thrift.I32 {
+			*f, _ = iprot.ReadI32()
+		} else {
+			iprot.Skip(t)
+		}
+		iprot.ReadFieldEnd()
+	}
+	return iprot.ReadStructEnd()
+}
+
+func writeI32s(oprot thrift.TProtocol, fs map[int16]int32) error {
+	oprot.WriteStructBegin("s")
+	for id, v := range fs {
+		oprot.WriteFieldBegin("", thrift.I32, id)
+		oprot.WriteI32(v)
+		oprot.WriteFieldEnd()
+	}
+	oprot.WriteFieldStop()
+	return oprot.WriteStructEnd()
+}
+
+type SharedServiceGetStructArgs struct {
+	Key int32 `thrift:"key,1" json:"key"`
+}
+
+func NewSharedServiceGetStructArgs() *SharedServiceGetStructArgs {
+	return &SharedServiceGetStructArgs{}
+}
+func (p *SharedServiceGetStructArgs) Read(iprot thrift.TProtocol) error {
+	return readI32s(iprot, map[int16]*int32{1: &p.Key})
+}
+
+type SharedServiceGetStructResult struct {
+	Success *SharedStruct `thrift:"success,0" json:"success,omitempty"`
+}
+
+func (p *SharedServiceGetStructResult) Write(oprot thrift.TProtocol) error {
+	oprot.WriteStructBegin("getStruct_result")
+	if p.Success != nil {
+		oprot.WriteFieldBegin("success", thrift.STRUCT, 0)
+		p.Success.Write(oprot)
+		oprot.WriteFieldEnd()
+	}
+	oprot.WriteFieldStop()
+	return oprot.WriteStructEnd()
+}
+
+type CalculatorPingArgs struct{}
+
+func NewCalculatorPingArgs() *CalculatorPingArgs { return &CalculatorPingArgs{} }
+func (p *CalculatorPingArgs) Read(iprot thrift.TProtocol) error {
+	return readI32s(iprot, nil)
+}
+
+type CalculatorPingResult struct{}
+
+func (p *CalculatorPingResult) Write(oprot thrift.TProtocol) error {
+	return writeI32s(oprot, nil)
+}
+
+type CalculatorAddArgs struct {
+	Num1 int32 `thrift:"num1,1" json:"num1"`
+	Num2 int32 `thrift:"num2,2" json:"num2"`
+}
+
+func NewCalculatorAddArgs() *CalculatorAddArgs { return &CalculatorAddArgs{} }
+func (p *CalculatorAddArgs) Read(iprot thrift.TProtocol) error {
+	return readI32s(iprot, map[int16]*int32{1: &p.Num1, 2: &p.Num2})
+}
+
+type CalculatorAddResult struct {
+	Success *int32 `thrift:"success,0" json:"success,omitempty"`
+}
+
+func (p *CalculatorAddResult) Write(oprot thrift.TProtocol) error {
+	m := map[int16]int32{}
+	if p.Success != nil {
+		m[0] = *p.Success
+	}
+	return writeI32s(oprot, m)
+}
+
+type CalculatorCalculateArgs struct {
+	Logid int32 `thrift:"logid,1" json:"logid"`
+	W     *Work `thrift:"w,2" json:"w"`
+}
+
+func NewCalculatorCalculateArgs() *CalculatorCalculateArgs { return &CalculatorCalculateArgs{} }
+func (p *CalculatorCalculateArgs) Read(iprot thrift.TProtocol) error {
+	p.W = &Work{}
+	iprot.ReadStructBegin()
+	for {
+		_, t, id, err := iprot.ReadFieldBegin()
+		if err != nil {
+			return err
+		}
+		if t == thrift.STOP {
+			break
+		}
+		switch {
+		case id == 1 && t == thrift.I32:
+			p.Logid, _ = iprot.ReadI32()
+		case id == 2 && t == thrift.STRUCT:
+			p.W.Read(iprot)
+		default:
+			iprot.Skip(t)
+		}
+		iprot.ReadFieldEnd()
+	}
+	return iprot.ReadStructEnd()
+}
+
+type CalculatorCalculateResult struct {
+	Success *int32            `thrift:"success,0" json:"success,omitempty"`
+	Ouch    *InvalidOperation `thrift:"ouch,1" json:"ouch,omitempty"`
+}
+
+func (p *CalculatorCalculateResult) Write(oprot thrift.TProtocol) error {
+	oprot.WriteStructBegin("calculate_result")
+	if p.Success != nil {
+		oprot.WriteFieldBegin("success", thrift.I32, 0)
+		oprot.WriteI32(*p.Success)
+		oprot.WriteFieldEnd()
+	}
+	if p.Ouch != nil {
+		oprot.WriteFieldBegin("ouch", thrift.STRUCT, 1)
+		p.Ouch.Write(oprot)
+		oprot.WriteFieldEnd()
+	}
+	oprot.WriteFieldStop()
+	return oprot.WriteStructEnd()
+}
+
+type CalculatorTagsArgs struct {
+	N int32 `thrift:"n,1" json:"n"`
+}
+
+func (p *CalculatorTagsArgs) Read(iprot thrift.TProtocol) error {
+	return readI32s(iprot, map[int16]*int32{1: &p.N})
+}
+
+type CalculatorTagsResult struct {
+	Success []string `thrift:"success,0" json:"success,omitempty"`
+}
+
+func (p *CalculatorTagsResult) Write(oprot thrift.TProtocol) error {
+	oprot.WriteStructBegin("tags_result")
+	oprot.WriteFieldBegin("success", thrift.LIST, 0)
+	oprot.WriteListBegin(thrift.STRING, len(p.Success))
+	for _, s := range p.Success {
+		oprot.WriteString(s)
+	}
+	oprot.WriteListEnd()
+	oprot.WriteFieldEnd()
+	oprot.WriteFieldStop()
+	return oprot.WriteStructEnd()
+}
+
+type CalculatorZipArgs struct{}
+
+func NewCalculatorZipArgs() *CalculatorZipArgs                 { return &CalculatorZipArgs{} }
+func (p *CalculatorZipArgs) Read(iprot thrift.TProtocol) error { return readI32s(iprot, nil) }
+
+type calculatorProcessorPing struct{ handler Calculator }
+type calculatorProcessorAdd struct{ handler Calculator }
+type calculatorProcessorCalculate struct{ handler Calculator }
+type calculatorProcessorTags struct{ handler Calculator }
+type calculatorProcessorZip struct{ handler Calculator }
+type sharedServiceProcessorGetStruct struct{ handler SharedService }
+
+type CalculatorProcessor struct {
+	processorMap map[string]interface{}
+}
+
+func NewSharedServiceProcessor(handler SharedService) *CalculatorProcessor {
+	self := &CalculatorProcessor{processorMap: map[string]interface{}{}}
+	self.processorMap["getStruct"] = &sharedServiceProcessorGetStruct{handler: handler}
+	return self
+}
+
+func NewCalculatorProcessor(handler Calculator) *CalculatorProcessor {
+	self := NewSharedServiceProcessor(handler)
+	self.processorMap["ping"] = &calculatorProcessorPing{handler: handler}
+	self.processorMap["add"] = &calculatorProcessorAdd{handler: handler}
+	self.processorMap["calculate"] = &calculatorProcessorCalculate{handler: handler}
+	self.processorMap["tags"] = &calculatorProcessorTags{handler: handler}
+	self.processorMap["zip"] = &calculatorProcessorZip{handler: handler}
+	return self
+}
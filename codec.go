@@ -0,0 +1,592 @@
+package thrifttools
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// decodeFunc reads one value into the settable v.
+type decodeFunc func(iprot thrift.TProtocol, v reflect.Value) error
+
+// encodeFunc writes the value v.
+type encodeFunc func(oprot thrift.TProtocol, v reflect.Value) error
+
+var (
+	readerType = reflect.TypeOf((*ThriftReader)(nil)).Elem()
+	writerType = reflect.TypeOf((*ThriftWriter)(nil)).Elem()
+)
+
+type fieldCodec struct {
+	index  int
+	decode decodeFunc
+	enum   bool
+}
+
+// decoder returns the decoder for a field that arrived with wire type.
+func (f fieldCodec) decoder(wire thrift.TType) decodeFunc {
+	if f.enum && wire == thrift.I32 {
+		return decodeEnum
+	}
+	return f.decode
+}
+
+// decodeEnum reads a generated enum, which is written with WriteI32.
+func decodeEnum(iprot thrift.TProtocol, v reflect.Value) error {
+	in, err := iprot.ReadI32()
+	if err != nil {
+		return thrift.PrependError("error reading field: ", err)
+	}
+	v.SetInt(int64(in))
+	return nil
+}
+
+// methodCodec is the codec plan of one handler method, compiled once when
+// the method is registered so calls skip a kind switch per value.
+type methodCodec struct {
+	ins      []reflect.Type
+	fields   map[int16]fieldCodec
+	wires    map[int16]thrift.TType
+	defaults []reflect.Value
+
+	outs     []encodeFunc
+	outIds   []int16
+	outWires []thrift.TType
+	nullable []bool
+}
+
+// compileMethod compiles the codec of a method. results are the wire types of
+// the result fields, see resultWires, and may be nil.
+func compileMethod(ins, outs []reflect.Type, ids map[int16]int, defaults []reflect.Value, results map[int16]*wirePlan) *methodCodec {
+	m := &methodCodec{
+		ins:      ins,
+		fields:   make(map[int16]fieldCodec, len(ids)),
+		wires:    make(map[int16]thrift.TType, len(ids)),
+		defaults: defaults,
+	}
+	for id, i := range ids {
+		if i < len(ins) {
+			m.fields[id] = fieldCodec{i, compileDecoder(ins[i]), isEnum(ins[i])}
+			m.wires[id] = ttype(ins[i])
+		}
+	}
+	for i, t := range outs {
+		id := int16(i)
+		if len(outs) == 1 {
+			id = 1
+		}
+		m.outs = append(m.outs, compileEncoder(t, results[id]))
+		m.outIds = append(m.outIds, id)
+		m.outWires = append(m.outWires, results[id].wireOf(t))
+		switch t.Kind() {
+		case reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+			m.nullable = append(m.nullable, true)
+		default:
+			m.nullable = append(m.nullable, false)
+		}
+	}
+	return m
+}
+
+// unpack decodes the args struct of a call into the handler arguments.
+// Fields are matched to arguments by ids, unknown fields and fields of an
+// unexpected wire type are skipped, and missing arguments take a copy of
+// their defaults or zero.
+func (m *methodCodec) unpack(iprot thrift.TProtocol) (args []reflect.Value, err error) {
+	if _, err = iprot.ReadStructBegin(); err != nil {
+		return nil, thrift.PrependError("read  args error: ", err)
+	}
+	args = make([]reflect.Value, len(m.ins))
+	for {
+		_, fieldTypeId, fieldId, err := iprot.ReadFieldBegin()
+		if err != nil {
+			return nil, thrift.PrependError(fmt.Sprintf("field %d read error: ", fieldId), err)
+		}
+		if fieldTypeId == thrift.STOP {
+			break
+		}
+		f, ok := m.fields[fieldId]
+		if wire := m.wires[fieldId]; ok && (fieldTypeId == wire || fieldTypeId == thrift.SET && wire == thrift.LIST || fieldTypeId == thrift.I32 && f.enum) {
+			v := reflect.New(m.ins[f.index]).Elem()
+			if err = f.decoder(fieldTypeId)(iprot, v); err != nil {
+				return nil, err
+			}
+			args[f.index] = v
+		} else if err = iprot.Skip(fieldTypeId); err != nil {
+			return nil, thrift.PrependError(fmt.Sprintf("field %d skip error: ", fieldId), err)
+		}
+		if err = iprot.ReadFieldEnd(); err != nil {
+			return nil, err
+		}
+	}
+	if err = iprot.ReadStructEnd(); err != nil {
+		return nil, thrift.PrependError("read struct end error: ", err)
+	}
+	for i, v := range args {
+		if v.IsValid() {
+			continue
+		}
+		if i < len(m.defaults) && m.defaults[i].IsValid() {
+			args[i] = copyValue(m.defaults[i])
+		} else {
+			args[i] = reflect.Zero(m.ins[i])
+		}
+	}
+	return args, nil
+}
+
+// pack writes the result struct of a call, leaving out nil results.
+func (m *methodCodec) pack(result_name string, results []reflect.Value, oprot thrift.TProtocol) error {
+	if err := oprot.WriteStructBegin(result_name); err != nil {
+		return thrift.PrependError(fmt.Sprintf("%s write struct begin error: ", result_name), err)
+	}
+	for i, out := range results {
+		if m.nullable[i] && out.IsNil() {
+			continue
+		}
+		if err := oprot.WriteFieldBegin("", m.outWires[i], m.outIds[i]); err != nil {
+			return thrift.PrependError("write field begin error.", err)
+		}
+		if err := m.outs[i](oprot, out); err != nil {
+			return err
+		}
+		if err := oprot.WriteFieldEnd(); err != nil {
+			return thrift.PrependError("write field end error.", err)
+		}
+	}
+	if err := oprot.WriteFieldStop(); err != nil {
+		return thrift.PrependError("write field stop error: ", err)
+	}
+	if err := oprot.WriteStructEnd(); err != nil {
+		return thrift.PrependError("write struct stop error: ", err)
+	}
+	return nil
+}
+
+func compileDecoder(t reflect.Type) decodeFunc {
+	switch t.Kind() {
+	case reflect.Bool:
+		return func(iprot thrift.TProtocol, v reflect.Value) error {
+			in, err := iprot.ReadBool()
+			if err != nil {
+				return thrift.PrependError("error reading field: ", err)
+			}
+			v.SetBool(in)
+			return nil
+		}
+	case reflect.Int8:
+		return func(iprot thrift.TProtocol, v reflect.Value) error {
+			in, err := iprot.ReadByte()
+			if err != nil {
+				return thrift.PrependError("error reading field: ", err)
+			}
+			v.SetInt(int64(in))
+			return nil
+		}
+	case reflect.Int16:
+		return func(iprot thrift.TProtocol, v reflect.Value) error {
+			in, err := iprot.ReadI16()
+			if err != nil {
+				return thrift.PrependError("error reading field: ", err)
+			}
+			v.SetInt(int64(in))
+			return nil
+		}
+	case reflect.Int32:
+		return func(iprot thrift.TProtocol, v reflect.Value) error {
+			in, err := iprot.ReadI32()
+			if err != nil {
+				return thrift.PrependError("error reading field: ", err)
+			}
+			v.SetInt(int64(in))
+			return nil
+		}
+	case reflect.Int64:
+		return func(iprot thrift.TProtocol, v reflect.Value) error {
+			in, err := iprot.ReadI64()
+			if err != nil {
+				return thrift.PrependError("error reading field: ", err)
+			}
+			v.SetInt(in)
+			return nil
+		}
+	case reflect.Float64:
+		return func(iprot thrift.TProtocol, v reflect.Value) error {
+			in, err := iprot.ReadDouble()
+			if err != nil {
+				return thrift.PrependError("error reading field: ", err)
+			}
+			v.SetFloat(in)
+			return nil
+		}
+	case reflect.String:
+		return func(iprot thrift.TProtocol, v reflect.Value) error {
+			in, err := iprot.ReadString()
+			if err != nil {
+				return thrift.PrependError("error reading field: ", err)
+			}
+			v.SetString(in)
+			return nil
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return func(iprot thrift.TProtocol, v reflect.Value) error {
+				in, err := iprot.ReadBinary()
+				if err != nil {
+					return thrift.PrependError("error reading field: ", err)
+				}
+				v.SetBytes(in)
+				return nil
+			}
+		}
+		elem := fieldCodec{decode: compileDecoder(t.Elem()), enum: isEnum(t.Elem())}
+		return func(iprot thrift.TProtocol, v reflect.Value) error {
+			wire, size, err := iprot.ReadListBegin()
+			if err != nil {
+				return thrift.PrependError("error reading list begin: ", err)
+			}
+			decode := elem.decoder(wire)
+			s := reflect.MakeSlice(t, size, size)
+			for i := 0; i < size; i++ {
+				if err := decode(iprot, s.Index(i)); err != nil {
+					return err
+				}
+			}
+			if err := iprot.ReadListEnd(); err != nil {
+				return thrift.PrependError("error reading list end: ", err)
+			}
+			v.Set(s)
+			return nil
+		}
+	case reflect.Map:
+		key := fieldCodec{decode: compileDecoder(t.Key()), enum: isEnum(t.Key())}
+		elem := fieldCodec{decode: compileDecoder(t.Elem()), enum: isEnum(t.Elem())}
+		return func(iprot thrift.TProtocol, v reflect.Value) error {
+			kwire, vwire, size, err := iprot.ReadMapBegin()
+			if err != nil {
+				return thrift.PrependError("error reading map begin: ", err)
+			}
+			keyDecode, elemDecode := key.decoder(kwire), elem.decoder(vwire)
+			m := reflect.MakeMapWithSize(t, size)
+			k, e := reflect.New(t.Key()).Elem(), reflect.New(t.Elem()).Elem()
+			for i := 0; i < size; i++ {
+				if err := keyDecode(iprot, k); err != nil {
+					return err
+				}
+				if err := elemDecode(iprot, e); err != nil {
+					return err
+				}
+				m.SetMapIndex(k, e)
+			}
+			if err := iprot.ReadMapEnd(); err != nil {
+				return thrift.PrependError("error reading map end: ", err)
+			}
+			v.Set(m)
+			return nil
+		}
+	case reflect.Ptr:
+		if t.Implements(readerType) {
+			return func(iprot thrift.TProtocol, v reflect.Value) error {
+				in := reflect.New(t.Elem())
+				if err := in.Interface().(ThriftReader).Read(iprot); err != nil {
+					return err
+				}
+				v.Set(in)
+				return nil
+			}
+		}
+	case reflect.Struct:
+		if reflect.PtrTo(t).Implements(readerType) {
+			return func(iprot thrift.TProtocol, v reflect.Value) error {
+				in := reflect.New(t)
+				if err := in.Interface().(ThriftReader).Read(iprot); err != nil {
+					return err
+				}
+				v.Set(in.Elem())
+				return nil
+			}
+		}
+	}
+	err := errors.New("unsupported argument type " + t.String())
+	return func(iprot thrift.TProtocol, v reflect.Value) error {
+		return err
+	}
+}
+
+// compileEncoder compiles the encoder of values of t, written with the wire
+// types of plan where it tells enums apart, see wirePlan.
+func compileEncoder(t reflect.Type, plan *wirePlan) encodeFunc {
+	switch t.Kind() {
+	case reflect.Bool:
+		return func(oprot thrift.TProtocol, v reflect.Value) error {
+			if err := oprot.WriteBool(v.Bool()); err != nil {
+				return thrift.PrependError("Bool write error.", err)
+			}
+			return nil
+		}
+	case reflect.Int8:
+		return func(oprot thrift.TProtocol, v reflect.Value) error {
+			if err := oprot.WriteByte(int8(v.Int())); err != nil {
+				return thrift.PrependError("Int8 write error.", err)
+			}
+			return nil
+		}
+	case reflect.Int16:
+		return func(oprot thrift.TProtocol, v reflect.Value) error {
+			if err := oprot.WriteI16(int16(v.Int())); err != nil {
+				return thrift.PrependError("Int16 write error.", err)
+			}
+			return nil
+		}
+	case reflect.Int32:
+		return func(oprot thrift.TProtocol, v reflect.Value) error {
+			if err := oprot.WriteI32(int32(v.Int())); err != nil {
+				return thrift.PrependError("Int32 write error.", err)
+			}
+			return nil
+		}
+	case reflect.Int64:
+		if plan.wireOf(t) == thrift.I32 {
+			return func(oprot thrift.TProtocol, v reflect.Value) error {
+				if err := oprot.WriteI32(int32(v.Int())); err != nil {
+					return thrift.PrependError("Int32 write error.", err)
+				}
+				return nil
+			}
+		}
+		return func(oprot thrift.TProtocol, v reflect.Value) error {
+			if err := oprot.WriteI64(v.Int()); err != nil {
+				return thrift.PrependError("Int64 write error.", err)
+			}
+			return nil
+		}
+	case reflect.Float64:
+		return func(oprot thrift.TProtocol, v reflect.Value) error {
+			if err := oprot.WriteDouble(v.Float()); err != nil {
+				return thrift.PrependError("Float64 write error.", err)
+			}
+			return nil
+		}
+	case reflect.String:
+		return func(oprot thrift.TProtocol, v reflect.Value) error {
+			if err := oprot.WriteString(v.String()); err != nil {
+				return thrift.PrependError("String write error.", err)
+			}
+			return nil
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return func(oprot thrift.TProtocol, v reflect.Value) error {
+				if err := oprot.WriteBinary(v.Bytes()); err != nil {
+					return thrift.PrependError("Binary write error.", err)
+				}
+				return nil
+			}
+		}
+		elem, wire := compileEncoder(t.Elem(), plan.elemPlan()), plan.elemPlan().wireOf(t.Elem())
+		return func(oprot thrift.TProtocol, v reflect.Value) error {
+			n := v.Len()
+			if err := oprot.WriteListBegin(wire, n); err != nil {
+				return thrift.PrependError("error writing list begin: ", err)
+			}
+			for i := 0; i < n; i++ {
+				if err := elem(oprot, v.Index(i)); err != nil {
+					return thrift.PrependError("list write error: ", err)
+				}
+			}
+			if err := oprot.WriteListEnd(); err != nil {
+				return thrift.PrependError("error writing list end: ", err)
+			}
+			return nil
+		}
+	case reflect.Map:
+		key, elem := compileEncoder(t.Key(), plan.keyPlan()), compileEncoder(t.Elem(), plan.elemPlan())
+		keyWire, elemWire := plan.keyPlan().wireOf(t.Key()), plan.elemPlan().wireOf(t.Elem())
+		return func(oprot thrift.TProtocol, v reflect.Value) error {
+			if err := oprot.WriteMapBegin(keyWire, elemWire, v.Len()); err != nil {
+				return thrift.PrependError("error writing map begin: ", err)
+			}
+			for it := v.MapRange(); it.Next(); {
+				if err := key(oprot, it.Key()); err != nil {
+					return thrift.PrependError("map field write error.", err)
+				}
+				if err := elem(oprot, it.Value()); err != nil {
+					return thrift.PrependError("map field write error.", err)
+				}
+			}
+			if err := oprot.WriteMapEnd(); err != nil {
+				return thrift.PrependError("error writing map end: ", err)
+			}
+			return nil
+		}
+	case reflect.Ptr, reflect.Interface:
+		return func(oprot thrift.TProtocol, v reflect.Value) error {
+			w, ok := v.Interface().(ThriftWriter)
+			if !ok {
+				return errors.New("unsupported result type " + v.Type().String())
+			}
+			return w.Write(oprot)
+		}
+	case reflect.Struct:
+		if reflect.PtrTo(t).Implements(writerType) {
+			return func(oprot thrift.TProtocol, v reflect.Value) error {
+				out := reflect.New(t)
+				out.Elem().Set(v)
+				return out.Interface().(ThriftWriter).Write(oprot)
+			}
+		}
+	}
+	err := errors.New("unsupported result type " + t.String())
+	return func(oprot thrift.TProtocol, v reflect.Value) error {
+		return err
+	}
+}
+
+// wirePlan is how a generated *_result struct writes a field: its wire type
+// and those of its elements. Go enums and i64 typedefs are both named int64
+// types, so only the generated code tells which are written as I32.
+type wirePlan struct {
+	wire      thrift.TType
+	key, elem *wirePlan
+}
+
+// wireOf returns the wire type of values of t, I32 for the enums of the plan.
+func (p *wirePlan) wireOf(t reflect.Type) thrift.TType {
+	if p != nil && p.wire == thrift.I32 && t.Kind() == reflect.Int64 {
+		return thrift.I32
+	}
+	return ttype(t)
+}
+
+func (p *wirePlan) keyPlan() *wirePlan {
+	if p == nil {
+		return nil
+	}
+	return p.key
+}
+
+func (p *wirePlan) elemPlan() *wirePlan {
+	if p == nil {
+		return nil
+	}
+	return p.elem
+}
+
+// resultWires writes a sample of the *_result struct t, with every field set
+// and one element in every container, and records the wire types its
+// generated Write uses by field id. It returns nil if t cannot be written.
+func resultWires(t reflect.Type) (plans map[int16]*wirePlan) {
+	if !reflect.PtrTo(t).Implements(writerType) {
+		return nil
+	}
+	result := reflect.New(t)
+	for i := 0; i < t.NumField(); i++ {
+		if _, ok := fieldId(t.Field(i).Tag); ok {
+			result.Elem().Field(i).Set(sampleValue(t.Field(i).Type))
+		}
+	}
+	r := &wireRecorder{
+		TProtocol: thrift.NewTBinaryProtocolTransport(thrift.NewTMemoryBuffer()),
+		fields:    make(map[int16]*wirePlan),
+	}
+	defer func() {
+		if recover() != nil {
+			plans = nil
+		}
+	}()
+	if err := result.Interface().(ThriftWriter).Write(r); err != nil {
+		return nil
+	}
+	return r.fields
+}
+
+// sampleValue returns a value of t with its containers holding one element,
+// so that writing it shows the wire types of the elements.
+func sampleValue(t reflect.Type) reflect.Value {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Ptr:
+		v.Set(reflect.New(t.Elem()))
+		if t.Elem().Kind() != reflect.Struct {
+			v.Elem().Set(sampleValue(t.Elem()))
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.Uint8 {
+			v.Set(reflect.Append(v, sampleValue(t.Elem())))
+		}
+	case reflect.Map:
+		v.Set(reflect.MakeMap(t))
+		v.SetMapIndex(sampleValue(t.Key()), sampleValue(t.Elem()))
+	}
+	return v
+}
+
+// wireRecorder is the protocol resultWires writes through. Containers are
+// written depth first, so the next container begin is that of the plan on
+// top of pending. Fields of nested structs are not recorded.
+type wireRecorder struct {
+	thrift.TProtocol
+	depth   int
+	fields  map[int16]*wirePlan
+	pending []*wirePlan
+}
+
+func (r *wireRecorder) push(plans ...*wirePlan) {
+	for _, p := range plans {
+		switch p.wire {
+		case thrift.LIST, thrift.SET, thrift.MAP:
+			r.pending = append(r.pending, p)
+		}
+	}
+}
+
+func (r *wireRecorder) pop() *wirePlan {
+	if r.depth != 1 || len(r.pending) == 0 {
+		return nil
+	}
+	p := r.pending[len(r.pending)-1]
+	r.pending = r.pending[:len(r.pending)-1]
+	return p
+}
+
+func (r *wireRecorder) WriteStructBegin(name string) error {
+	r.depth++
+	return nil
+}
+
+func (r *wireRecorder) WriteStructEnd() error {
+	r.depth--
+	return nil
+}
+
+func (r *wireRecorder) WriteFieldBegin(name string, typeId thrift.TType, id int16) error {
+	if r.depth == 1 {
+		p := &wirePlan{wire: typeId}
+		r.fields[id] = p
+		r.push(p)
+	}
+	return nil
+}
+
+func (r *wireRecorder) WriteListBegin(elemType thrift.TType, size int) error {
+	if p := r.pop(); p != nil {
+		p.elem = &wirePlan{wire: elemType}
+		r.push(p.elem)
+	}
+	return nil
+}
+
+func (r *wireRecorder) WriteSetBegin(elemType thrift.TType, size int) error {
+	return r.WriteListBegin(elemType, size)
+}
+
+func (r *wireRecorder) WriteMapBegin(keyType thrift.TType, valueType thrift.TType, size int) error {
+	if p := r.pop(); p != nil {
+		p.key, p.elem = &wirePlan{wire: keyType}, &wirePlan{wire: valueType}
+		//the key is written first, so its containers go on top
+		r.push(p.elem, p.key)
+	}
+	return nil
+}
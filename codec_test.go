@@ -0,0 +1,325 @@
+package thrifttools
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+type benchHandler struct{}
+
+func (benchHandler) Query(key string, limit int32, tags []string, weights map[string]int64) ([]string, error) {
+	return tags, nil
+}
+
+func benchArgs() []byte {
+	buf := thrift.NewTMemoryBuffer()
+	oprot := thrift.NewTBinaryProtocolTransport(buf)
+	oprot.WriteStructBegin("Query_args")
+	oprot.WriteFieldBegin("key", thrift.STRING, 1)
+	oprot.WriteString("user:1024")
+	oprot.WriteFieldEnd()
+	oprot.WriteFieldBegin("limit", thrift.I32, 2)
+	oprot.WriteI32(100)
+	oprot.WriteFieldEnd()
+	oprot.WriteFieldBegin("tags", thrift.LIST, 3)
+	oprot.WriteListBegin(thrift.STRING, 8)
+	for i := 0; i < 8; i++ {
+		oprot.WriteString("tag")
+	}
+	oprot.WriteListEnd()
+	oprot.WriteFieldEnd()
+	oprot.WriteFieldBegin("weights", thrift.MAP, 4)
+	oprot.WriteMapBegin(thrift.STRING, thrift.I64, 4)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		oprot.WriteString(k)
+		oprot.WriteI64(1)
+	}
+	oprot.WriteMapEnd()
+	oprot.WriteFieldEnd()
+	oprot.WriteFieldStop()
+	oprot.WriteStructEnd()
+	return buf.Bytes()
+}
+
+func BenchmarkUnpackReflect(b *testing.B) {
+	mw := NewThriftMidWare(benchHandler{})
+	data := benchArgs()
+	buf := thrift.NewTMemoryBuffer()
+	iprot := thrift.NewTBinaryProtocolTransport(buf)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		buf.Write(data)
+		if _, err := unpack(mw.insType["Query"], mw.argIds["Query"], nil, iprot); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnpackCodec(b *testing.B) {
+	mw := NewThriftMidWare(benchHandler{})
+	data := benchArgs()
+	buf := thrift.NewTMemoryBuffer()
+	iprot := thrift.NewTBinaryProtocolTransport(buf)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		buf.Write(data)
+		if _, err := mw.codecs["Query"].unpack(iprot); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchResults() []reflect.Value {
+	tags := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	var err error
+	return []reflect.Value{reflect.ValueOf(tags), reflect.ValueOf(&err).Elem()}
+}
+
+func BenchmarkPackReflect(b *testing.B) {
+	results := benchResults()
+	buf := thrift.NewTMemoryBuffer()
+	oprot := thrift.NewTBinaryProtocolTransport(buf)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := pack("Query_result", results, oprot); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPackCodec(b *testing.B) {
+	mw := NewThriftMidWare(benchHandler{})
+	results := benchResults()
+	buf := thrift.NewTMemoryBuffer()
+	oprot := thrift.NewTBinaryProtocolTransport(buf)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := mw.codecs["Query"].pack("Query_result", results, oprot); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Shade is an enum the way the Go generator declares it.
+type Shade int64
+
+type shadeHandler struct{}
+
+func (shadeHandler) Pick(s Shade) (Shade, error) { return s + 1, nil }
+
+func (shadeHandler) Range(n int32) (map[string][]Shade, error) {
+	return map[string][]Shade{"r": {Shade(n)}}, nil
+}
+
+type shadePickResult struct {
+	Success *Shade `thrift:"success,0"`
+}
+
+func (p *shadePickResult) Write(oprot thrift.TProtocol) error {
+	oprot.WriteStructBegin("Pick_result")
+	if p.Success != nil {
+		oprot.WriteFieldBegin("success", thrift.I32, 0)
+		oprot.WriteI32(int32(*p.Success))
+		oprot.WriteFieldEnd()
+	}
+	oprot.WriteFieldStop()
+	return oprot.WriteStructEnd()
+}
+
+type shadeRangeResult struct {
+	Success map[string][]Shade `thrift:"success,0"`
+}
+
+func (p *shadeRangeResult) Write(oprot thrift.TProtocol) error {
+	oprot.WriteStructBegin("Range_result")
+	if p.Success != nil {
+		oprot.WriteFieldBegin("success", thrift.MAP, 0)
+		oprot.WriteMapBegin(thrift.STRING, thrift.LIST, len(p.Success))
+		for k, v := range p.Success {
+			oprot.WriteString(k)
+			oprot.WriteListBegin(thrift.I32, len(v))
+			for _, e := range v {
+				oprot.WriteI32(int32(e))
+			}
+			oprot.WriteListEnd()
+		}
+		oprot.WriteMapEnd()
+		oprot.WriteFieldEnd()
+	}
+	oprot.WriteFieldStop()
+	return oprot.WriteStructEnd()
+}
+
+func TestEnumResults(t *testing.T) {
+	mw := NewThriftMidWare(shadeHandler{})
+	mw.MethodResult("Pick", &shadePickResult{})
+	mw.MethodResult("Range", &shadeRangeResult{})
+
+	in, out := thrift.NewTMemoryBuffer(), thrift.NewTMemoryBuffer()
+	iprot, oprot := thrift.NewTBinaryProtocolTransport(in), thrift.NewTBinaryProtocolTransport(out)
+	iprot.WriteMessageBegin("Pick", thrift.CALL, 1)
+	iprot.WriteStructBegin("Pick_args")
+	iprot.WriteFieldBegin("s", thrift.I32, 1)
+	iprot.WriteI32(2)
+	iprot.WriteFieldEnd()
+	iprot.WriteFieldStop()
+	iprot.WriteStructEnd()
+	mw.Process(iprot, oprot)
+	oprot.ReadMessageBegin()
+	oprot.ReadStructBegin()
+	if _, fieldTypeId, fieldId, _ := oprot.ReadFieldBegin(); fieldTypeId != thrift.I32 || fieldId != 0 {
+		t.Fatal("Pick", fieldTypeId, fieldId)
+	}
+	if v, _ := oprot.ReadI32(); v != 3 {
+		t.Fatal("Pick", v)
+	}
+
+	in.Reset()
+	out.Reset()
+	iprot.WriteMessageBegin("Range", thrift.CALL, 2)
+	iprot.WriteStructBegin("Range_args")
+	iprot.WriteFieldBegin("n", thrift.I32, 1)
+	iprot.WriteI32(4)
+	iprot.WriteFieldEnd()
+	iprot.WriteFieldStop()
+	iprot.WriteStructEnd()
+	mw.Process(iprot, oprot)
+	oprot.ReadMessageBegin()
+	oprot.ReadStructBegin()
+	if _, fieldTypeId, _, _ := oprot.ReadFieldBegin(); fieldTypeId != thrift.MAP {
+		t.Fatal("Range", fieldTypeId)
+	}
+	oprot.ReadMapBegin()
+	oprot.ReadString()
+	if elemType, size, _ := oprot.ReadListBegin(); elemType != thrift.I32 || size != 1 {
+		t.Fatal("Range", elemType, size)
+	}
+	if v, _ := oprot.ReadI32(); v != 4 {
+		t.Fatal("Range", v)
+	}
+}
+
+func TestCodecMatchesReflect(t *testing.T) {
+	mw := NewThriftMidWare(benchHandler{})
+	buf := thrift.NewTMemoryBuffer()
+	iprot := thrift.NewTBinaryProtocolTransport(buf)
+	buf.Write(benchArgs())
+	want, err := unpack(mw.insType["Query"], mw.argIds["Query"], nil, iprot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	buf.Write(benchArgs())
+	got, err := mw.codecs["Query"].unpack(iprot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i].Interface(), want[i].Interface()) {
+			t.Fatal("arg", i, got[i], want[i])
+		}
+	}
+
+	var noErr error
+	results := [][]reflect.Value{
+		benchResults(),
+		{reflect.ValueOf(&noErr).Elem()},
+		{reflect.ValueOf(int32(7)), reflect.ValueOf(&noErr).Elem()},
+		{reflect.ValueOf(map[string][]int64{"a": {1, 2}}), reflect.ValueOf(&noErr).Elem()},
+		{reflect.ValueOf([][]byte{[]byte("x")}), reflect.ValueOf(&noErr).Elem()},
+		{reflect.ValueOf([]string(nil)), reflect.ValueOf(&noErr).Elem()},
+	}
+	for _, outs := range results {
+		types := make([]reflect.Type, len(outs))
+		for i, out := range outs {
+			types[i] = out.Type()
+		}
+		m := compileMethod(nil, types, nil, nil, nil)
+		reflectBuf, codecBuf := thrift.NewTMemoryBuffer(), thrift.NewTMemoryBuffer()
+		if err := pack("r", outs, thrift.NewTBinaryProtocolTransport(reflectBuf)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.pack("r", outs, thrift.NewTBinaryProtocolTransport(codecBuf)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(codecBuf.Bytes(), reflectBuf.Bytes()) {
+			t.Fatal(types, codecBuf.Bytes(), reflectBuf.Bytes())
+		}
+	}
+}
+
+type queryArgs struct {
+	Key     string           `thrift:"key,1"`
+	Limit   int32            `thrift:"limit,2"`
+	Tags    []string         `thrift:"tags,3"`
+	Weights map[string]int64 `thrift:"weights,4"`
+}
+
+func TestUnpackArgs(t *testing.T) {
+	mw := NewThriftMidWare(benchHandler{})
+	buf := thrift.NewTMemoryBuffer()
+	p := thrift.NewTBinaryProtocolTransport(buf)
+
+	//fields out of order, an unknown id, an id past the last argument and
+	//a wrong wire type
+	p.WriteStructBegin("Query_args")
+	p.WriteFieldBegin("weights", thrift.MAP, 4)
+	p.WriteMapBegin(thrift.STRING, thrift.I64, 1)
+	p.WriteString("a")
+	p.WriteI64(2)
+	p.WriteMapEnd()
+	p.WriteFieldEnd()
+	p.WriteFieldBegin("extra", thrift.LIST, 9)
+	p.WriteListBegin(thrift.I32, 1)
+	p.WriteI32(1)
+	p.WriteListEnd()
+	p.WriteFieldEnd()
+	p.WriteFieldBegin("next", thrift.STRING, 5)
+	p.WriteString("x")
+	p.WriteFieldEnd()
+	p.WriteFieldBegin("limit", thrift.STRING, 2)
+	p.WriteString("100")
+	p.WriteFieldEnd()
+	p.WriteFieldBegin("key", thrift.STRING, 1)
+	p.WriteString("k")
+	p.WriteFieldEnd()
+	p.WriteFieldStop()
+	p.WriteStructEnd()
+	args, err := mw.codecs["Query"].unpack(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args[0].String() != "k" || args[1].Int() != 0 || !args[2].IsNil() || args[3].Len() != 1 {
+		t.Fatal(args)
+	}
+
+	//missing arguments take a copy of the defaults
+	mw.MethodArgs("Query", &queryArgs{Limit: 10, Tags: []string{"d"}})
+	for i := 0; i < 2; i++ {
+		p.WriteStructBegin("Query_args")
+		p.WriteFieldBegin("key", thrift.STRING, 1)
+		p.WriteString("k")
+		p.WriteFieldEnd()
+		p.WriteFieldStop()
+		p.WriteStructEnd()
+		args, err := mw.codecs["Query"].unpack(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args[1].Int() != 10 || args[2].Len() != 1 || args[2].Index(0).String() != "d" {
+			t.Fatal(i, args)
+		}
+		args[2].Index(0).SetString("changed")
+	}
+}
@@ -1,20 +1,41 @@
 package thrifttools
 
 import (
+	"context"
+	"fmt"
 	"math"
+	"net"
 	"reflect"
+	"sync"
+	"time"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
 )
 
 const abortIndex int8 = math.MaxInt8 / 2
 
+// Outcomes of a call, see Context.Outcome.
+const (
+	OutcomeOK        = "ok"
+	OutcomeException = "exception"
+	OutcomeError     = "error"
+	OutcomeAbort     = "abort"
+)
+
 type Context struct {
-	SeqId int32
-	Iprot thrift.TProtocol
-	Oprot thrift.TProtocol
-	Err   error
+	SeqId       int32
+	MessageType thrift.TMessageType
+	Iprot       thrift.TProtocol
+	Oprot       thrift.TProtocol
+	//client connection, see ThriftMidWare.GetProcessor
+	Transport thrift.TTransport
+	Err       error
+	//peer of a detached call, see detach
+	conn net.Conn
+	addr net.Addr
 
+	//service name of a multiplexed call
+	Service  string
 	Name     string
 	handlers handlersChain
 	index    int8
@@ -22,20 +43,99 @@ type Context struct {
 	Ins      []reflect.Value
 	Outs     []reflect.Value
 	Method   reflect.Value
+	//set instead of Method, Ins and Outs for generated processors
+	Call StaticCall
+
+	ctx context.Context
+
+	//values passed down the chain with Set and Get
+	mu   sync.RWMutex
+	Keys map[string]interface{}
+	//THeader headers of the call and of the reply
+	requestHeaders  map[string]string
+	responseHeaders map[string]string
 }
 
 func (c *Context) reset() {
 	c.SeqId = -1
+	c.MessageType = thrift.INVALID_TMESSAGE_TYPE
 	c.Iprot = nil
 	c.Oprot = nil
+	c.Transport = nil
+	c.conn = nil
+	c.addr = nil
 
 	c.Err = nil
 
+	c.Service = ""
 	c.Name = ""
 	c.handlers = c.handlers[0:0]
 	c.index = -1
 	c.Midware = nil
+	c.Ins = nil
+	c.Outs = nil
+	c.Call = nil
+	c.ctx = nil
+
+	c.mu.Lock()
+	c.Keys = nil
+	c.requestHeaders = nil
+	c.responseHeaders = nil
+	c.mu.Unlock()
+}
+
+// clone copies c, for the rest of the chain to run on another goroutine.
+func (c *Context) clone() *Context {
+	cc := &Context{}
+	if c.Midware != nil {
+		cc = c.Midware.pool.Get().(*Context)
+	}
+	cc.reset()
+	cc.SeqId = c.SeqId
+	cc.MessageType = c.MessageType
+	cc.Iprot = c.Iprot
+	cc.Oprot = c.Oprot
+	cc.Transport = c.Transport
+	cc.conn = c.conn
+	cc.addr = c.addr
+	cc.Err = c.Err
+	cc.Service = c.Service
+	cc.Name = c.Name
+	cc.handlers = c.handlers
+	cc.index = c.index
+	cc.Midware = c.Midware
+	cc.Ins = c.Ins
+	cc.Outs = c.Outs
+	cc.Method = c.Method
+	cc.Call = c.Call
+	cc.ctx = c.ctx
+	cc.requestHeaders = c.requestHeaders
+	c.mu.RLock()
+	for k, v := range c.Keys {
+		cc.Set(k, v)
+	}
+	for k, v := range c.responseHeaders {
+		cc.SetResponseHeader(k, v)
+	}
+	c.mu.RUnlock()
+	return cc
 }
+
+// detach keeps what the chain reads off the connection and drops the
+// protocols, for a oneway call served while the connection reads the next.
+func (c *Context) detach() {
+	c.conn, c.addr = c.Conn(), c.RemoteAddr()
+	c.Iprot = nil
+	c.Oprot = nil
+	c.Transport = nil
+}
+
+func (c *Context) release() {
+	if c.Midware != nil {
+		c.Midware.pool.Put(c)
+	}
+}
+
 func (c *Context) Next() {
 	c.index++
 	s := int8(len(c.handlers))
@@ -49,5 +149,187 @@ func (c *Context) AbortWithError(err error) {
 }
 
 func (c *Context) IsAbort() bool {
-	return c.index == abortIndex
+	//Next moves past abortIndex once the aborting handler returns
+	return c.index >= abortIndex
+}
+
+// Context returns the context.Context of the call, passed to handlers whose
+// first parameter is a context.Context.
+func (c *Context) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// WithContext replaces the context.Context of the call, for middleware adding
+// a deadline or request scoped values.
+func (c *Context) WithContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// Outcome tells how the call ended once the rest of the chain returned: ok,
+// a declared exception, an application error of the handler, or aborted by
+// middleware, with the error if any.
+func (c *Context) Outcome() (outcome string, err error) {
+	if c.IsAbort() && c.Err != nil {
+		return OutcomeAbort, c.Err
+	}
+	if c.Call != nil {
+		if err, declared := c.Call.Err(); err != nil {
+			if declared {
+				return OutcomeException, err
+			}
+			return OutcomeError, err
+		}
+		return OutcomeOK, nil
+	}
+	for _, out := range c.Outs {
+		if IsNull(out) {
+			continue
+		}
+		if err, ok := out.Interface().(error); ok {
+			if x, ok := err.(ThriftException); ok && c.Midware != nil {
+				if _, ok := c.Midware.declaredId(c, x); ok {
+					return OutcomeException, err
+				}
+			}
+			return OutcomeError, err
+		}
+	}
+	return OutcomeOK, nil
+}
+
+// RemoteAddr returns the address of the client, or nil when the transport
+// does not tell.
+func (c *Context) RemoteAddr() net.Addr {
+	if conn := c.Conn(); conn != nil {
+		return conn.RemoteAddr()
+	}
+	if t, ok := c.Transport.(interface{ RemoteAddr() net.Addr }); ok {
+		return t.RemoteAddr()
+	}
+	return c.addr
+}
+
+// Conn returns the client connection under the transport, or nil when the
+// transport does not tell.
+func (c *Context) Conn() net.Conn {
+	t := c.Transport
+	for t != nil {
+		switch tt := t.(type) {
+		case interface{ Conn() net.Conn }:
+			return tt.Conn()
+		case interface{ Underlying() thrift.TTransport }:
+			t = tt.Underlying()
+		default:
+			return nil
+		}
+	}
+	return c.conn
+}
+
+// RequestHeaders returns the THeader headers of the call, nil unless it
+// was read with a THeaderProtocol.
+func (c *Context) RequestHeaders() map[string]string {
+	return c.requestHeaders
+}
+
+// SetResponseHeader sets a THeader header of the reply. It is dropped for
+// clients not using THeader.
+func (c *Context) SetResponseHeader(key, value string) {
+	c.mu.Lock()
+	if c.responseHeaders == nil {
+		c.responseHeaders = make(map[string]string)
+	}
+	c.responseHeaders[key] = value
+	c.mu.Unlock()
+}
+
+// Set stores a value for later middleware and the handler of this call.
+func (c *Context) Set(key string, value interface{}) {
+	c.mu.Lock()
+	if c.Keys == nil {
+		c.Keys = make(map[string]interface{})
+	}
+	c.Keys[key] = value
+	c.mu.Unlock()
+}
+
+func (c *Context) Get(key string) (value interface{}, exists bool) {
+	c.mu.RLock()
+	value, exists = c.Keys[key]
+	c.mu.RUnlock()
+	return
+}
+
+// MustGet returns the value for key and panics if it was never set.
+func (c *Context) MustGet(key string) interface{} {
+	if value, exists := c.Get(key); exists {
+		return value
+	}
+	panic(fmt.Sprintf("thrifttools: key %q does not exist", key))
+}
+
+func (c *Context) GetString(key string) (s string) {
+	if v, ok := c.Get(key); ok && v != nil {
+		s, _ = v.(string)
+	}
+	return
+}
+
+func (c *Context) GetBool(key string) (b bool) {
+	if v, ok := c.Get(key); ok && v != nil {
+		b, _ = v.(bool)
+	}
+	return
+}
+
+func (c *Context) GetInt(key string) (i int) {
+	if v, ok := c.Get(key); ok && v != nil {
+		i, _ = v.(int)
+	}
+	return
+}
+
+func (c *Context) GetInt32(key string) (i int32) {
+	if v, ok := c.Get(key); ok && v != nil {
+		i, _ = v.(int32)
+	}
+	return
+}
+
+func (c *Context) GetInt64(key string) (i int64) {
+	if v, ok := c.Get(key); ok && v != nil {
+		i, _ = v.(int64)
+	}
+	return
+}
+
+func (c *Context) GetFloat64(key string) (f float64) {
+	if v, ok := c.Get(key); ok && v != nil {
+		f, _ = v.(float64)
+	}
+	return
+}
+
+func (c *Context) GetDuration(key string) (d time.Duration) {
+	if v, ok := c.Get(key); ok && v != nil {
+		d, _ = v.(time.Duration)
+	}
+	return
+}
+
+func (c *Context) GetStringSlice(key string) (ss []string) {
+	if v, ok := c.Get(key); ok && v != nil {
+		ss, _ = v.([]string)
+	}
+	return
+}
+
+func (c *Context) GetStringMap(key string) (sm map[string]interface{}) {
+	if v, ok := c.Get(key); ok && v != nil {
+		sm, _ = v.(map[string]interface{})
+	}
+	return
 }
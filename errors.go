@@ -0,0 +1,42 @@
+package thrifttools
+
+import (
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// MappedError is the reply to a failed call: a declared exception of the
+// method, written to its result field, or else a TApplicationException of
+// TypeId and Message. An exception the method does not declare, by
+// MethodResult or a generated call, is replied as INTERNAL_ERROR.
+type MappedError struct {
+	Exception ThriftException
+	TypeId    int32
+	Message   string
+}
+
+// ErrorMapper turns the error a handler returned, or a middleware aborted
+// the call with, into the reply to the client.
+type ErrorMapper func(c *Context, err error, aborted bool) MappedError
+
+// DefaultErrorMapper replies errors of built-in middleware with their own
+// exception type, e.g. ExceptionRateLimited, and other errors as
+// INTERNAL_ERROR naming the method.
+func DefaultErrorMapper(c *Context, err error, aborted bool) MappedError {
+	if typed, ok := err.(interface {
+		TypeId() int32
+	}); ok {
+		return MappedError{TypeId: typed.TypeId(), Message: err.Error()}
+	}
+	msg := "Internal error processing " + c.Name + ": "
+	if _, panicked := err.(*PanicError); aborted && !panicked {
+		msg = "Middleware error processing " + c.Name + ": "
+	}
+	return MappedError{TypeId: thrift.INTERNAL_ERROR, Message: msg + err.Error()}
+}
+
+// MapErrors replaces DefaultErrorMapper, for example to reply validation
+// errors as a declared exception or with a type id of their own. Mappers
+// usually handle the errors they know and defer to DefaultErrorMapper.
+func (this *ThriftMidWare) MapErrors(mapper ErrorMapper) {
+	this.errorMapper = mapper
+}
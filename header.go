@@ -0,0 +1,437 @@
+package thrifttools
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// THeader protocol ids of the payload.
+const (
+	THeaderProtocolBinary  = 0
+	THeaderProtocolCompact = 2
+)
+
+// THeader transforms applied to the payload.
+const (
+	THeaderTransformZlib = 1
+)
+
+const (
+	headerMagic        = 0x0fff
+	headerInfoKeyValue = 1
+	//same as the default of TFramedTransport
+	maxHeaderFrameSize = 16384000
+)
+
+type headerClientType int
+
+const (
+	clientHeader headerClientType = iota
+	clientFramedBinary
+	clientFramedCompact
+	clientUnframedBinary
+	clientUnframedCompact
+)
+
+// THeaderTransport frames messages the THeader way, carrying string headers
+// and the protocol of the payload along with each message. Reading, it also
+// accepts framed and unframed binary and compact messages, and answers
+// those clients the same way.
+type THeaderTransport struct {
+	trans thrift.TTransport
+
+	clientType headerClientType
+	detected   bool
+	ProtocolID int
+	Transforms []int
+	seqID      uint32
+
+	readHeaders  map[string]string
+	writeHeaders map[string]string
+
+	frame  *bytes.Reader
+	prefix []byte
+	wbuf   bytes.Buffer
+}
+
+// NewTHeaderTransport wraps trans, unless it is a THeaderTransport already.
+func NewTHeaderTransport(trans thrift.TTransport) *THeaderTransport {
+	if t, ok := trans.(*THeaderTransport); ok {
+		return t
+	}
+	return &THeaderTransport{trans: trans, frame: bytes.NewReader(nil)}
+}
+
+func (t *THeaderTransport) Open() error {
+	return t.trans.Open()
+}
+
+func (t *THeaderTransport) IsOpen() bool {
+	return t.trans.IsOpen()
+}
+
+func (t *THeaderTransport) Close() error {
+	return t.trans.Close()
+}
+
+// Underlying returns the wrapped transport.
+func (t *THeaderTransport) Underlying() thrift.TTransport {
+	return t.trans
+}
+
+// ReadHeaders returns the headers of the last message read.
+func (t *THeaderTransport) ReadHeaders() map[string]string {
+	return t.readHeaders
+}
+
+// SetWriteHeader sets a header of the next message flushed.
+func (t *THeaderTransport) SetWriteHeader(key, value string) {
+	if t.writeHeaders == nil {
+		t.writeHeaders = make(map[string]string)
+	}
+	t.writeHeaders[key] = value
+}
+
+func (t *THeaderTransport) unframed() bool {
+	return t.clientType == clientUnframedBinary || t.clientType == clientUnframedCompact
+}
+
+// ReadFrame reads the next message, called before reading its header.
+func (t *THeaderTransport) ReadFrame() error {
+	if t.detected && t.unframed() {
+		return nil
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(t.trans, size[:]); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	if !t.detected {
+		switch {
+		case size[0] == 0x80 && size[1] == 0x01:
+			t.clientType, t.ProtocolID, t.detected = clientUnframedBinary, THeaderProtocolBinary, true
+		case size[0] == 0x82:
+			t.clientType, t.ProtocolID, t.detected = clientUnframedCompact, THeaderProtocolCompact, true
+		}
+		if t.detected {
+			t.prefix = append([]byte(nil), size[:]...)
+			return nil
+		}
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxHeaderFrameSize {
+		return thrift.NewTTransportException(thrift.UNKNOWN_TRANSPORT_EXCEPTION, fmt.Sprintf("frame size %d exceeds the maximum", n))
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(t.trans, buf); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	switch {
+	case n >= 10 && binary.BigEndian.Uint16(buf) == headerMagic:
+		t.clientType = clientHeader
+		if err := t.parseHeader(buf); err != nil {
+			return thrift.NewTTransportExceptionFromError(err)
+		}
+	case n >= 2 && buf[0] == 0x80 && buf[1] == 0x01:
+		t.clientType, t.ProtocolID = clientFramedBinary, THeaderProtocolBinary
+		t.frame.Reset(buf)
+	case n >= 1 && buf[0] == 0x82:
+		t.clientType, t.ProtocolID = clientFramedCompact, THeaderProtocolCompact
+		t.frame.Reset(buf)
+	default:
+		return thrift.NewTTransportException(thrift.UNKNOWN_TRANSPORT_EXCEPTION, "unknown frame type")
+	}
+	t.detected = true
+	return nil
+}
+
+// parseHeader reads a THeader frame:
+//
+//	magic(2) flags(2) seqid(4) header size/4 (2) header payload
+//
+// the header being the varint protocol id, transforms and info blocks.
+func (t *THeaderTransport) parseHeader(buf []byte) error {
+	t.seqID = binary.BigEndian.Uint32(buf[4:])
+	size := int(binary.BigEndian.Uint16(buf[8:])) * 4
+	if 10+size > len(buf) {
+		return errors.New("header size exceeds the frame")
+	}
+	header, payload := bytes.NewReader(buf[10:10+size]), buf[10+size:]
+
+	protocolID, err := binary.ReadUvarint(header)
+	if err != nil {
+		return err
+	}
+	if protocolID != THeaderProtocolBinary && protocolID != THeaderProtocolCompact {
+		return fmt.Errorf("unsupported protocol id %d", protocolID)
+	}
+	t.ProtocolID = int(protocolID)
+	n, err := binary.ReadUvarint(header)
+	if err != nil {
+		return err
+	}
+	t.Transforms = t.Transforms[:0]
+	for i := uint64(0); i < n; i++ {
+		id, err := binary.ReadUvarint(header)
+		if err != nil {
+			return err
+		}
+		if id != THeaderTransformZlib {
+			return fmt.Errorf("unsupported transform %d", id)
+		}
+		t.Transforms = append(t.Transforms, int(id))
+	}
+
+	t.readHeaders = make(map[string]string)
+	for header.Len() > 0 {
+		info, err := binary.ReadUvarint(header)
+		//zero is padding, and info blocks of unknown types end the header
+		if err != nil || info != headerInfoKeyValue {
+			break
+		}
+		count, err := binary.ReadUvarint(header)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			key, err := readVarString(header)
+			if err != nil {
+				return err
+			}
+			value, err := readVarString(header)
+			if err != nil {
+				return err
+			}
+			t.readHeaders[key] = value
+		}
+	}
+
+	for i := len(t.Transforms) - 1; i >= 0; i-- {
+		r, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		//a small frame may inflate without bound
+		if payload, err = ioutil.ReadAll(io.LimitReader(r, maxHeaderFrameSize+1)); err != nil {
+			return err
+		}
+		if len(payload) > maxHeaderFrameSize {
+			return errors.New("inflated payload exceeds the maximum frame size")
+		}
+	}
+	t.frame.Reset(payload)
+	return nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func readVarString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", errors.New("header string exceeds the header")
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
+
+func (t *THeaderTransport) Read(p []byte) (int, error) {
+	if t.detected && t.unframed() {
+		if len(t.prefix) > 0 {
+			n := copy(p, t.prefix)
+			t.prefix = t.prefix[n:]
+			return n, nil
+		}
+		return t.trans.Read(p)
+	}
+	return t.frame.Read(p)
+}
+
+func (t *THeaderTransport) RemainingBytes() uint64 {
+	if t.detected && t.unframed() {
+		return t.trans.RemainingBytes()
+	}
+	return uint64(t.frame.Len())
+}
+
+func (t *THeaderTransport) Write(p []byte) (int, error) {
+	return t.wbuf.Write(p)
+}
+
+// Flush writes the buffered message framed as the client of the last
+// message read expects, with the write headers set since the last Flush.
+func (t *THeaderTransport) Flush() error {
+	if t.wbuf.Len() == 0 {
+		return t.trans.Flush()
+	}
+	defer func() {
+		t.wbuf.Reset()
+		t.writeHeaders = nil
+	}()
+	var frame []byte
+	switch t.clientType {
+	case clientUnframedBinary, clientUnframedCompact:
+		frame = t.wbuf.Bytes()
+	case clientFramedBinary, clientFramedCompact:
+		frame = make([]byte, 4, 4+t.wbuf.Len())
+		binary.BigEndian.PutUint32(frame, uint32(t.wbuf.Len()))
+		frame = append(frame, t.wbuf.Bytes()...)
+	default:
+		var err error
+		if frame, err = t.headerFrame(); err != nil {
+			return thrift.NewTTransportExceptionFromError(err)
+		}
+	}
+	if _, err := t.trans.Write(frame); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return t.trans.Flush()
+}
+
+func (t *THeaderTransport) headerFrame() ([]byte, error) {
+	var header []byte
+	header = appendUvarint(header, uint64(t.ProtocolID))
+	header = appendUvarint(header, uint64(len(t.Transforms)))
+	for _, id := range t.Transforms {
+		header = appendUvarint(header, uint64(id))
+	}
+	if len(t.writeHeaders) > 0 {
+		header = appendUvarint(header, headerInfoKeyValue)
+		header = appendUvarint(header, uint64(len(t.writeHeaders)))
+		for k, v := range t.writeHeaders {
+			header = appendUvarint(header, uint64(len(k)))
+			header = append(header, k...)
+			header = appendUvarint(header, uint64(len(v)))
+			header = append(header, v...)
+		}
+	}
+	for len(header)%4 != 0 {
+		header = append(header, 0)
+	}
+	if len(header)/4 > 0xffff {
+		return nil, errors.New("headers too large")
+	}
+
+	payload := t.wbuf.Bytes()
+	for range t.Transforms {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		w.Write(payload)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		payload = buf.Bytes()
+	}
+
+	frame := make([]byte, 14, 14+len(header)+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(10+len(header)+len(payload)))
+	binary.BigEndian.PutUint16(frame[4:], headerMagic)
+	binary.BigEndian.PutUint32(frame[8:], t.seqID)
+	binary.BigEndian.PutUint16(frame[12:], uint16(len(header)/4))
+	frame = append(frame, header...)
+	return append(frame, payload...), nil
+}
+
+// THeaderProtocol reads and writes messages with the protocol THeader frames
+// name, binary or compact.
+type THeaderProtocol struct {
+	thrift.TProtocol
+	trans      *THeaderTransport
+	protocolID int
+}
+
+func NewTHeaderProtocol(trans thrift.TTransport) *THeaderProtocol {
+	t := NewTHeaderTransport(trans)
+	p := &THeaderProtocol{trans: t}
+	p.protocolID = -1
+	p.setProtocol()
+	return p
+}
+
+func (p *THeaderProtocol) setProtocol() {
+	if p.protocolID == p.trans.ProtocolID {
+		return
+	}
+	p.protocolID = p.trans.ProtocolID
+	if p.protocolID == THeaderProtocolCompact {
+		p.TProtocol = thrift.NewTCompactProtocol(p.trans)
+	} else {
+		p.TProtocol = thrift.NewTBinaryProtocolTransport(p.trans)
+	}
+}
+
+func (p *THeaderProtocol) ReadMessageBegin() (name string, typeId thrift.TMessageType, seqId int32, err error) {
+	if err = p.trans.ReadFrame(); err != nil {
+		return
+	}
+	p.setProtocol()
+	return p.TProtocol.ReadMessageBegin()
+}
+
+func (p *THeaderProtocol) WriteMessageBegin(name string, typeId thrift.TMessageType, seqId int32) error {
+	p.setProtocol()
+	return p.TProtocol.WriteMessageBegin(name, typeId, seqId)
+}
+
+func (p *THeaderProtocol) Flush() error {
+	if err := p.TProtocol.Flush(); err != nil {
+		return err
+	}
+	return p.trans.Flush()
+}
+
+func (p *THeaderProtocol) Transport() thrift.TTransport {
+	return p.trans
+}
+
+// HeaderTransport returns the THeaderTransport of the protocol.
+func (p *THeaderProtocol) HeaderTransport() *THeaderTransport {
+	return p.trans
+}
+
+type THeaderProtocolFactory struct{}
+
+func NewTHeaderProtocolFactory() *THeaderProtocolFactory {
+	return &THeaderProtocolFactory{}
+}
+
+func (f *THeaderProtocolFactory) GetProtocol(t thrift.TTransport) thrift.TProtocol {
+	return NewTHeaderProtocol(t)
+}
+
+// headerProtocol returns the THeaderProtocol under p, if any.
+func headerProtocol(p thrift.TProtocol) *THeaderProtocol {
+	for {
+		switch t := p.(type) {
+		case *THeaderProtocol:
+			return t
+		case *Protocol:
+			p = t.TProtocol
+		default:
+			return nil
+		}
+	}
+}
+
+// headerOutput answers on the protocol the call was read from when both
+// protocols frame the same connection, as servers build one of each, so
+// the reply gets the client framing and response headers.
+func headerOutput(iprot, oprot thrift.TProtocol) thrift.TProtocol {
+	in, out := headerProtocol(iprot), headerProtocol(oprot)
+	if in == nil || out == nil || in == out || in.trans.trans != out.trans.trans {
+		return oprot
+	}
+	return iprot
+}
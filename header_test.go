@@ -0,0 +1,151 @@
+package thrifttools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+type echoHandler struct{}
+
+func (echoHandler) Echo(s string) (string, error) {
+	if s == "panic" {
+		panic("echo")
+	}
+	return s, nil
+}
+
+// bufferPair reads what the peer wrote to r and writes for the peer to w.
+type bufferPair struct {
+	r, w *bytes.Buffer
+}
+
+func (b *bufferPair) Read(p []byte) (int, error)  { return b.r.Read(p) }
+func (b *bufferPair) Write(p []byte) (int, error) { return b.w.Write(p) }
+func (b *bufferPair) Close() error                { return nil }
+func (b *bufferPair) Flush() error                { return nil }
+func (b *bufferPair) Open() error                 { return nil }
+func (b *bufferPair) IsOpen() bool                { return true }
+func (b *bufferPair) RemainingBytes() uint64      { return ^uint64(0) }
+
+func writeEcho(p thrift.TProtocol, s string) {
+	p.WriteMessageBegin("Echo", thrift.CALL, 5)
+	p.WriteStructBegin("Echo_args")
+	p.WriteFieldBegin("s", thrift.STRING, 1)
+	p.WriteString(s)
+	p.WriteFieldEnd()
+	p.WriteFieldStop()
+	p.WriteStructEnd()
+	p.WriteMessageEnd()
+}
+
+func readEcho(t *testing.T, p thrift.TProtocol) string {
+	name, typeId, seqId, err := p.ReadMessageBegin()
+	if err != nil || name != "Echo" || typeId != thrift.REPLY || seqId != 5 {
+		t.Fatal(name, typeId, seqId, err)
+	}
+	p.ReadStructBegin()
+	_, fieldTypeId, fieldId, err := p.ReadFieldBegin()
+	if err != nil || fieldTypeId != thrift.STRING || fieldId != 0 {
+		t.Fatal(fieldTypeId, fieldId, err)
+	}
+	s, err := p.ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestTHeaderRoundTrip(t *testing.T) {
+	cases := []struct {
+		name       string
+		protocolID int
+		transforms []int
+	}{
+		{"binary", THeaderProtocolBinary, nil},
+		{"compact", THeaderProtocolCompact, nil},
+		{"zlib", THeaderProtocolBinary, []int{THeaderTransformZlib}},
+	}
+	for _, tc := range cases {
+		c2s, s2c := &bytes.Buffer{}, &bytes.Buffer{}
+		client := NewTHeaderProtocol(&bufferPair{s2c, c2s})
+		client.HeaderTransport().ProtocolID = tc.protocolID
+		client.HeaderTransport().Transforms = tc.transforms
+		client.HeaderTransport().SetWriteHeader("caller", "test")
+		writeEcho(client, "hello")
+		client.Flush()
+
+		mw := NewThriftMidWare(echoHandler{})
+		var caller string
+		mw.Use(func(c *Context) {
+			caller = c.RequestHeaders()["caller"]
+			c.SetResponseHeader("served-by", tc.name)
+		})
+		server := NewTHeaderProtocol(&bufferPair{c2s, s2c})
+		if ok, err := mw.Process(server, server); !ok || err != nil {
+			t.Fatal(tc.name, ok, err)
+		}
+		if caller != "test" {
+			t.Fatal(tc.name, "request headers", caller)
+		}
+		if s := readEcho(t, client); s != "hello" {
+			t.Fatal(tc.name, s)
+		}
+		if h := client.HeaderTransport().ReadHeaders(); h["served-by"] != tc.name {
+			t.Fatal(tc.name, "response headers", h)
+		}
+		if got := client.HeaderTransport().Transforms; len(got) != len(tc.transforms) {
+			t.Fatal(tc.name, "transforms", got)
+		}
+	}
+}
+
+func TestTHeaderFramedAndUnframed(t *testing.T) {
+	protocols := map[string]func(thrift.TTransport) thrift.TProtocol{
+		"binary":  func(t thrift.TTransport) thrift.TProtocol { return thrift.NewTBinaryProtocolTransport(t) },
+		"compact": func(t thrift.TTransport) thrift.TProtocol { return thrift.NewTCompactProtocol(t) },
+	}
+	for name, newProtocol := range protocols {
+		for _, framed := range []bool{true, false} {
+			msg := thrift.NewTMemoryBuffer()
+			writeEcho(newProtocol(msg), "hello")
+			c2s, s2c := &bytes.Buffer{}, &bytes.Buffer{}
+			if framed {
+				binary.Write(c2s, binary.BigEndian, uint32(msg.Len()))
+			}
+			c2s.Write(msg.Bytes())
+
+			mw := NewThriftMidWare(echoHandler{})
+			server := NewTHeaderProtocol(&bufferPair{c2s, s2c})
+			if ok, err := mw.Process(server, server); !ok || err != nil {
+				t.Fatal(name, framed, ok, err)
+			}
+			if framed {
+				if n := binary.BigEndian.Uint32(s2c.Next(4)); int(n) != s2c.Len() {
+					t.Fatal(name, "frame size", n, s2c.Len())
+				}
+			}
+			if s := readEcho(t, newProtocol(&bufferPair{s2c, nil})); s != "hello" {
+				t.Fatal(name, framed, s)
+			}
+		}
+	}
+}
+
+func TestTHeaderZlibLimit(t *testing.T) {
+	c2s := &bytes.Buffer{}
+	client := NewTHeaderProtocol(&bufferPair{nil, c2s})
+	client.HeaderTransport().Transforms = []int{THeaderTransformZlib}
+	writeEcho(client, strings.Repeat("a", maxHeaderFrameSize))
+	client.Flush()
+	if c2s.Len() > maxHeaderFrameSize/100 {
+		t.Fatal("payload not compressed", c2s.Len())
+	}
+	server := NewTHeaderProtocol(&bufferPair{c2s, nil})
+	if _, _, _, err := server.ReadMessageBegin(); err == nil {
+		t.Fatal("inflated payload over the frame limit read")
+	}
+}
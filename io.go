@@ -3,6 +3,8 @@ package thrifttools
 import (
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
 )
@@ -41,178 +43,81 @@ var Typmap = map[reflect.Kind]thrift.TType{
 	reflect.Interface: thrift.STRUCT,
 }
 
-func unpack(instype []reflect.Type, iprot thrift.TProtocol) (args []reflect.Value, err error) {
-
-	if _, err = iprot.ReadStructBegin(); err != nil {
-		err = thrift.PrependError(fmt.Sprintf("read  args error: "), err)
-		return
-	}
-	for i := 0; ; i++ {
-		_, fieldTypeId, fieldId, err2 := iprot.ReadFieldBegin()
-		if err2 != nil {
-			err = thrift.PrependError(fmt.Sprintf("field %d read error: ", fieldId), err2)
-			return
-		}
-		if fieldTypeId == thrift.STOP {
-			break
-		}
-
-		v, err2 := readArg(instype[i], iprot)
-		if err2 != nil {
-			err = err2
-			return
-		}
-
-		if err = iprot.ReadFieldEnd(); err != nil {
-			return
-		}
-		args = append(args, v)
+// ttype returns the wire type of values of t.
+func ttype(t reflect.Type) thrift.TType {
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+		return thrift.STRING
 	}
+	return Typmap[t.Kind()]
+}
 
-	if err = iprot.ReadStructEnd(); err != nil {
-		err = thrift.PrependError(fmt.Sprintf("read struct end error: "), err)
-		return
-	}
-	return args, nil
+// matches reports whether a field of wire type can be read into t.
+func matches(t reflect.Type, wire thrift.TType) bool {
+	want := ttype(t)
+	return wire == want || wire == thrift.SET && want == thrift.LIST || wire == thrift.I32 && isEnum(t)
 }
 
-func readArg(tpy reflect.Type, iprot thrift.TProtocol) (value reflect.Value, err error) {
-	var err2 error
-	switch tpy.Kind() {
-	case reflect.Bool:
-		var in bool
-		if in, err = iprot.ReadBool(); err != nil {
-			err2 = thrift.PrependError("error reading field: ", err)
-		} else {
-			value = reflect.ValueOf(in)
-		}
-	case reflect.Int8:
-		var in int8
-		if in, err = iprot.ReadByte(); err != nil {
-			err2 = thrift.PrependError("error reading field: ", err)
-		} else {
-			value = reflect.ValueOf(in)
-		}
-	case reflect.Int16:
-		var in int16
-		if in, err = iprot.ReadI16(); err != nil {
-			err2 = thrift.PrependError("error reading field: ", err)
-		} else {
-			value = reflect.ValueOf(in)
-		}
-	case reflect.Int32:
-		var in int32
-		if in, err = iprot.ReadI32(); err != nil {
-			err2 = thrift.PrependError("error reading field: ", err)
-		} else {
-			value = reflect.ValueOf(in)
-		}
-	case reflect.Int64:
-		var in int64
-		if in, err = iprot.ReadI64(); err != nil {
-			err2 = thrift.PrependError("error reading field: ", err)
-		} else {
-			value = reflect.ValueOf(in)
-		}
+// isEnum reports whether t may be a generated enum. The Go generator declares
+// enums as named int64 types but writes them with WriteI32.
+func isEnum(t reflect.Type) bool {
+	return t.Kind() == reflect.Int64 && t.PkgPath() != ""
+}
 
-	case reflect.Float64:
-		var in float64
-		if in, err = iprot.ReadDouble(); err != nil {
-			err2 = thrift.PrependError("error reading field: ", err)
-		} else {
-			value = reflect.ValueOf(in)
+// copyValue returns a copy of a default argument, so that a handler mutating
+// a pointer, map or slice argument does not change the default of later calls.
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
 		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(copyValue(v.Elem()))
+		return c
 	case reflect.Map:
-		_, _, size, err := iprot.ReadMapBegin()
-		if err != nil {
-			err2 = thrift.PrependError("error reading map begin: ", err)
-			break
-		}
-		value = reflect.MakeMap(tpy)
-		for i := 0; i < size; i++ {
-			k, err := readArg(tpy.Key(), iprot)
-			if err != nil {
-				err2 = err
-				break
-			}
-			v, err := readArg(tpy.Elem(), iprot)
-			if err != nil {
-				err2 = err
-				break
-			}
-			value.SetMapIndex(k, v)
+		if v.IsNil() {
+			return v
 		}
-		if err = iprot.ReadMapEnd(); err != nil {
-			err2 = thrift.PrependError("error reading map end: ", err)
+		c := reflect.MakeMap(v.Type())
+		for _, k := range v.MapKeys() {
+			c.SetMapIndex(copyValue(k), copyValue(v.MapIndex(k)))
 		}
-	case reflect.Ptr:
-		in := reflect.New(tpy.Elem())
-		err = in.Interface().(ThriftReader).Read(iprot)
-		if err != nil {
-			err2 = err
-			break
-		}
-		value = in
+		return c
 	case reflect.Slice:
-		_, size, err := iprot.ReadListBegin()
-		if err != nil {
-			err2 = thrift.PrependError("error reading list begin: ", err)
-			break
+		if v.IsNil() {
+			return v
 		}
-		value = reflect.MakeSlice(tpy, 0, size)
-		for i := 0; i < size; i++ {
-			v, err := readArg(tpy.Elem(), iprot)
-			if err != nil {
-				err2 = err
-				break
-			}
-			value = reflect.Append(value, v)
-		}
-		if err := iprot.ReadListEnd(); err != nil {
-			err2 = thrift.PrependError("error reading list end: ", err)
-		}
-	case reflect.String:
-		if in, err2 := iprot.ReadString(); err != nil {
-			err = thrift.PrependError("error reading field: ", err2)
-
-		} else {
-			value = reflect.ValueOf(in)
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i)))
 		}
+		return c
 	case reflect.Struct:
-		value = reflect.Zero(tpy)
-		err = value.Interface().(ThriftReader).Read(iprot)
-		if err != nil {
-			err2 = err
-			break
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if f := c.Field(i); f.CanSet() {
+				f.Set(copyValue(v.Field(i)))
+			}
 		}
-	default:
-
+		return c
 	}
-	return value, err2
+	return v
 }
 
-func pack(result_name string, results []reflect.Value, oprot thrift.TProtocol) (err error) {
+// packException writes a result struct holding only the exception at field id.
+func packException(result_name string, id int16, exception ThriftException, oprot thrift.TProtocol) (err error) {
 	if err := oprot.WriteStructBegin(result_name); err != nil {
 		return thrift.PrependError(fmt.Sprintf("%s write struct begin error: ", result_name), err)
 	}
-	idx := 0
-	if len(results) == 1 {
-		idx = 1
+	if err := oprot.WriteFieldBegin("", thrift.STRUCT, id); err != nil {
+		return thrift.PrependError(fmt.Sprintf("%d write field begin error: ", id), err)
 	}
-	for _, out := range results {
-		if !IsNull(out) {
-			if err := oprot.WriteFieldBegin("", Typmap[out.Kind()], int16(idx)); err != nil {
-				return thrift.PrependError(fmt.Sprintf("write field begin error."), err)
-			}
-			err = writeResult(out, oprot)
-			if err != nil {
-				return
-			}
-			if err = oprot.WriteFieldEnd(); err != nil {
-				return thrift.PrependError(fmt.Sprintf("write field end error."), err)
-			}
-		}
-		idx += 1
+	if err := exception.Write(oprot); err != nil {
+		return err
+	}
+	if err := oprot.WriteFieldEnd(); err != nil {
+		return thrift.PrependError(fmt.Sprintf("%d write field end error: ", id), err)
 	}
 	if err := oprot.WriteFieldStop(); err != nil {
 		return thrift.PrependError("write field stop error: ", err)
@@ -222,81 +127,19 @@ func pack(result_name string, results []reflect.Value, oprot thrift.TProtocol) (
 	}
 	return nil
 }
-func writeResult(out reflect.Value, oprot thrift.TProtocol) (err error) {
-
-	switch out.Kind() {
-	case reflect.Bool:
-		if err := oprot.WriteBool(out.Interface().(bool)); err != nil {
-			return thrift.PrependError(fmt.Sprintf("Bool write error."), err)
-		}
-	case reflect.Int8:
-		if err := oprot.WriteByte(out.Interface().(int8)); err != nil {
-			return thrift.PrependError(fmt.Sprintf("Int8 write error."), err)
-		}
-	case reflect.Int16:
-		if err := oprot.WriteI16(out.Interface().(int16)); err != nil {
-			return thrift.PrependError(fmt.Sprintf("Int16 write error."), err)
-		}
-	case reflect.Int32:
-		if err := oprot.WriteI32(out.Interface().(int32)); err != nil {
-			return thrift.PrependError(fmt.Sprintf("Int32 write error."), err)
-		}
-	case reflect.Int64:
-		if err := oprot.WriteI64(out.Interface().(int64)); err != nil {
-			return thrift.PrependError(fmt.Sprintf("Int64 write error."), err)
-		}
-	case reflect.Float64:
-		if err := oprot.WriteDouble(out.Interface().(float64)); err != nil {
-			return thrift.PrependError(fmt.Sprintf("Float64 write error."), err)
-		}
-	case reflect.Map:
-		if err := oprot.WriteMapBegin(Typmap[out.Type().Key().Kind()], Typmap[out.Type().Elem().Kind()], out.Len()); err != nil {
-			return thrift.PrependError("error writing map begin: ", err)
-		}
-		for _, v := range out.MapKeys() {
-			if err := writeResult(v, oprot); err != nil {
-				return thrift.PrependError(fmt.Sprintf("map field write error."), err)
-			}
-
-			if err := writeResult(out.MapIndex(v), oprot); err != nil {
-				return thrift.PrependError(fmt.Sprintf("map field write error."), err)
-			}
-		}
-		if err := oprot.WriteMapEnd(); err != nil {
-			return thrift.PrependError("error writing map end: ", err)
-		}
-	case reflect.Interface:
-		fallthrough
-	case reflect.Ptr:
-		err := out.Interface().(ThriftWriter).Write(oprot)
-		if err != nil {
-			return err
-		}
-	case reflect.Slice:
-		if err := oprot.WriteListBegin(Typmap[out.Type().Elem().Kind()], out.Len()); err != nil {
-			return thrift.PrependError("error writing list begin: ", err)
-		}
-		for i := 0; i < out.Len(); i++ {
-			if err := writeResult(out.Index(i), oprot); err != nil {
-				return thrift.PrependError(fmt.Sprintf("list write error: "), err)
-			}
-		}
-		if err := oprot.WriteListEnd(); err != nil {
-			return thrift.PrependError("error writing list end: ", err)
-		}
-	case reflect.String:
-		if err := oprot.WriteString(out.Interface().(string)); err != nil {
-			return thrift.PrependError(fmt.Sprintf("String write error."), err)
-		}
-	case reflect.Struct:
-		err := out.Interface().(ThriftWriter).Write(oprot)
-		if err != nil {
-			return err
-		}
-	default:
 
+// fieldId returns the field id of a generated struct field, tagged like
+// `thrift:"name,1"` or `thrift:"name,1,required"`.
+func fieldId(tag reflect.StructTag) (int16, bool) {
+	parts := strings.Split(tag.Get("thrift"), ",")
+	if len(parts) < 2 {
+		return 0, false
 	}
-	return nil
+	id, err := strconv.ParseInt(parts[1], 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return int16(id), true
 }
 
 func IsNull(v reflect.Value) bool {
@@ -0,0 +1,83 @@
+package thrifttools
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// LimitAlgorithm adjusts the concurrency limit of an adaptive Pool. Update is
+// called with the pool locked each time a borrowed connection is released,
+// with the number of connections in use and the outcome of the call.
+type LimitAlgorithm interface {
+	Update(limit float64, inflight int, latency time.Duration, err error) float64
+}
+
+// AIMDLimit grows the limit by one for every successful call made while the
+// pool is busy, and multiplies it by BackoffRatio when a call fails or takes
+// longer than Timeout.
+type AIMDLimit struct {
+	Timeout      time.Duration
+	BackoffRatio float64
+}
+
+func NewAIMDLimit(timeout time.Duration) *AIMDLimit {
+	return &AIMDLimit{Timeout: timeout, BackoffRatio: 0.9}
+}
+
+func (a *AIMDLimit) Update(limit float64, inflight int, latency time.Duration, err error) float64 {
+	if err != nil || (a.Timeout > 0 && latency > a.Timeout) {
+		ratio := a.BackoffRatio
+		if ratio <= 0 || ratio >= 1 {
+			ratio = 0.9
+		}
+		return limit * ratio
+	}
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// GradientLimit compares each call latency against a long term average and
+// shrinks the limit as the backend queues up, in the manner of the gradient2
+// limiter. Failed calls are treated as the worst gradient. Its average is
+// guarded by its own lock, but shared by every Pool using it, so give each
+// Pool its own GradientLimit to track the latency of one backend.
+type GradientLimit struct {
+	Tolerance float64
+	Smoothing float64
+	Window    int
+
+	mu      sync.Mutex
+	longRtt float64
+	samples int
+}
+
+func NewGradientLimit() *GradientLimit {
+	return &GradientLimit{Tolerance: 1.5, Smoothing: 0.2, Window: 600}
+}
+
+func (g *GradientLimit) Update(limit float64, inflight int, latency time.Duration, err error) float64 {
+	rtt := float64(latency)
+	g.mu.Lock()
+	if g.samples < g.Window {
+		g.samples += 1
+	}
+	if g.longRtt == 0 {
+		g.longRtt = rtt
+	} else {
+		g.longRtt += (rtt - g.longRtt) / float64(g.samples)
+	}
+	longRtt := g.longRtt
+	g.mu.Unlock()
+	if float64(inflight)*2 < limit && err == nil {
+		return limit
+	}
+	gradient := 0.5
+	if err == nil && rtt > 0 {
+		gradient = math.Max(0.5, math.Min(1, g.Tolerance*longRtt/rtt))
+	}
+	newLimit := limit*gradient + math.Sqrt(limit)
+	return limit*(1-g.Smoothing) + newLimit*g.Smoothing
+}
@@ -0,0 +1,322 @@
+package thrifttools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel orders log records, with the values of log/slog.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+type LogAttr struct {
+	Key   string
+	Value interface{}
+}
+
+type LogRecord struct {
+	Time    time.Time
+	Level   LogLevel
+	Message string
+	Attrs   []LogAttr
+}
+
+// LogHandler writes log records, like a log/slog Handler; adapting one takes
+// a few lines.
+type LogHandler interface {
+	Enabled(level LogLevel) bool
+	Handle(r LogRecord) error
+}
+
+// NewTextLogHandler writes records as key=value lines to w.
+func NewTextLogHandler(w io.Writer, level LogLevel) LogHandler {
+	return &streamLogHandler{w: w, level: level}
+}
+
+// NewJSONLogHandler writes records as one JSON object per line to w.
+func NewJSONLogHandler(w io.Writer, level LogLevel) LogHandler {
+	return &streamLogHandler{w: w, level: level, json: true}
+}
+
+type streamLogHandler struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level LogLevel
+	json  bool
+}
+
+func (h *streamLogHandler) Enabled(level LogLevel) bool {
+	return level >= h.level
+}
+
+func (h *streamLogHandler) Handle(r LogRecord) error {
+	var line []byte
+	if h.json {
+		m := make(map[string]interface{}, len(r.Attrs)+3)
+		for _, a := range r.Attrs {
+			m[a.Key] = logValue(a.Value)
+		}
+		m["time"], m["level"], m["msg"] = r.Time, r.Level.String(), r.Message
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		line = append(b, '\n')
+	} else {
+		var b strings.Builder
+		b.WriteString("time=" + r.Time.Format(time.RFC3339Nano))
+		b.WriteString(" level=" + r.Level.String())
+		b.WriteString(" msg=" + textValue(r.Message))
+		for _, a := range r.Attrs {
+			b.WriteString(" " + a.Key + "=" + textValue(logValue(a.Value)))
+		}
+		b.WriteByte('\n')
+		line = []byte(b.String())
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(line)
+	return err
+}
+
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func textValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case nil:
+		return "<nil>"
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			s = fmt.Sprint(v)
+		} else {
+			s = string(b)
+		}
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// LoggerOptions configures the Logger middleware.
+type LoggerOptions struct {
+	//defaults to text on stderr at LevelInfo
+	Handler LogHandler
+	Message string
+	//log the decoded arguments and results of reflection handlers
+	Args    bool
+	Results bool
+	//Redact hides fields of the logged arguments and results, as "Field" for
+	//any method or "Method.Field" with Method a path.Match pattern. Field is
+	//the Go or thrift name of a struct field, at any depth, or argN for the
+	//Nth argument
+	Redact []string
+	//SampleRate is the share of successful calls logged, 1 if zero, and
+	//MethodSampleRates overrides it per method. Failed calls are always
+	//logged
+	SampleRate        float64
+	MethodSampleRates map[string]float64
+}
+
+const redacted = "[REDACTED]"
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Logger records one structured line per call with the method, seq id, peer
+// address, latency and outcome of the call, at LevelError for application
+// errors and aborted calls.
+func Logger(opts LoggerOptions) HandlerFunc {
+	l := &accessLog{opts: opts, redact: make(map[string][]string)}
+	if l.opts.Handler == nil {
+		l.opts.Handler = NewTextLogHandler(os.Stderr, LevelInfo)
+	}
+	if l.opts.Message == "" {
+		l.opts.Message = "thrift call"
+	}
+	for _, rule := range opts.Redact {
+		method, field := "*", rule
+		if i := strings.LastIndex(rule, "."); i >= 0 {
+			method, field = rule[:i], rule[i+1:]
+		}
+		l.redact[field] = append(l.redact[field], method)
+	}
+	return l.handle
+}
+
+type accessLog struct {
+	opts LoggerOptions
+	//methods patterns by field
+	redact map[string][]string
+}
+
+func (l *accessLog) handle(c *Context) {
+	start := nowFun()
+	panicked := true
+	//deferred, so a call panicking up to Recovery is still logged
+	defer func() { l.log(c, start, panicked) }()
+	c.Next()
+	panicked = false
+}
+
+func (l *accessLog) log(c *Context, start time.Time, panicked bool) {
+	latency := nowFun().Sub(start)
+
+	outcome, err := c.Outcome()
+	if panicked {
+		outcome, err = OutcomeError, errPanicked
+	}
+	level := LevelInfo
+	switch outcome {
+	case OutcomeOK:
+		rate := l.opts.SampleRate
+		if r, ok := l.opts.MethodSampleRates[c.Name]; ok {
+			rate = r
+		}
+		if rate > 0 && rate < 1 && rand.Float64() >= rate {
+			return
+		}
+	case OutcomeError, OutcomeAbort:
+		level = LevelError
+	}
+	if !l.opts.Handler.Enabled(level) {
+		return
+	}
+
+	attrs := make([]LogAttr, 0, 10)
+	if c.Service != "" {
+		attrs = append(attrs, LogAttr{"service", c.Service})
+	}
+	attrs = append(attrs, LogAttr{"method", c.Name}, LogAttr{"seqid", c.SeqId})
+	if addr := c.RemoteAddr(); addr != nil {
+		attrs = append(attrs, LogAttr{"peer", addr.String()})
+	}
+	attrs = append(attrs, LogAttr{"latency", latency}, LogAttr{"result", outcome})
+	if err != nil {
+		attrs = append(attrs, LogAttr{"error", err})
+	}
+	if l.opts.Args && c.Ins != nil {
+		args := make([]interface{}, len(c.Ins))
+		for i, in := range c.Ins {
+			if l.redacted(c.Name, "arg"+strconv.Itoa(i+1)) {
+				args[i] = redacted
+			} else {
+				args[i] = l.value(c.Name, in, 0)
+			}
+		}
+		attrs = append(attrs, LogAttr{"args", args})
+	}
+	if l.opts.Results && outcome == OutcomeOK && c.Outs != nil {
+		results := make([]interface{}, 0, len(c.Outs))
+		for _, out := range c.Outs {
+			if !out.Type().Implements(errorType) {
+				results = append(results, l.value(c.Name, out, 0))
+			}
+		}
+		attrs = append(attrs, LogAttr{"results", results})
+	}
+	l.opts.Handler.Handle(LogRecord{Time: start, Level: level, Message: l.opts.Message, Attrs: attrs})
+}
+
+func (l *accessLog) redacted(method, field string) bool {
+	for _, pattern := range l.redact[field] {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// value copies v into maps and slices the log handler can print, hiding
+// redacted fields.
+func (l *accessLog) value(method string, v reflect.Value, depth int) interface{} {
+	if depth > 16 {
+		return "..."
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return l.value(method, v.Elem(), depth+1)
+	case reflect.Struct:
+		m := make(map[string]interface{}, v.NumField())
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(f.Tag.Get("thrift"), ",")[0]
+			if l.redacted(method, f.Name) || (name != "" && l.redacted(method, name)) {
+				m[f.Name] = redacted
+				continue
+			}
+			m[f.Name] = l.value(method, v.Field(i), depth+1)
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return fmt.Sprintf("[%d bytes]", v.Len())
+		}
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = l.value(method, v.Index(i), depth+1)
+		}
+		return s
+	case reflect.Map:
+		m := make(map[string]interface{}, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			m[fmt.Sprint(l.value(method, it.Key(), depth+1))] = l.value(method, it.Value(), depth+1)
+		}
+		return m
+	}
+	if v.CanInterface() {
+		return v.Interface()
+	}
+	return fmt.Sprint(v)
+}
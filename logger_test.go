@@ -0,0 +1,17 @@
+package thrifttools
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLoggerPanic(t *testing.T) {
+	var buf bytes.Buffer
+	mw := NewThriftMidWare(echoHandler{})
+	mw.Use(quietRecovery(), Logger(LoggerOptions{Handler: NewTextLogHandler(&buf, LevelInfo)}))
+	callEcho(t, mw, "panic")
+	if out := buf.String(); !strings.Contains(out, "level=ERROR") || !strings.Contains(out, "method=Echo") || !strings.Contains(out, "result=error") {
+		t.Fatal(out)
+	}
+}
@@ -0,0 +1,208 @@
+package thrifttools
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the latency histogram upper bounds in seconds.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var outcomes = [...]string{OutcomeOK, OutcomeException, OutcomeError, OutcomeAbort}
+
+// Metrics counts calls by method and outcome, the calls in flight and their
+// latency. Middleware records them and, as an http.Handler, Metrics exposes
+// them in the Prometheus text format, or OpenMetrics when the scraper asks
+// for it.
+type Metrics struct {
+	//metric names are prefixed with Namespace_, default thrift_server
+	Namespace string
+	//histogram buckets, DefaultBuckets if nil, and per method overrides
+	Buckets       []float64
+	MethodBuckets map[string][]float64
+
+	mu      sync.RWMutex
+	methods map[methodKey]*methodMetrics
+}
+
+type methodKey struct {
+	service, method string
+}
+
+type methodMetrics struct {
+	inFlight int64
+	requests [len(outcomes)]uint64
+
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{Namespace: "thrift_server", methods: make(map[methodKey]*methodMetrics)}
+}
+
+func (m *Metrics) method(service, method string) *methodMetrics {
+	key := methodKey{service, method}
+	m.mu.RLock()
+	mm, ok := m.methods[key]
+	m.mu.RUnlock()
+	if ok {
+		return mm
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mm, ok = m.methods[key]; ok {
+		return mm
+	}
+	if m.methods == nil {
+		m.methods = make(map[methodKey]*methodMetrics)
+	}
+	buckets, ok := m.MethodBuckets[method]
+	if !ok {
+		buckets = m.Buckets
+	}
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	mm = &methodMetrics{buckets: buckets, counts: make([]uint64, len(buckets))}
+	m.methods[key] = mm
+	return mm
+}
+
+// Middleware records the calls going through the rest of the chain.
+func (m *Metrics) Middleware() HandlerFunc {
+	return func(c *Context) {
+		mm := m.method(c.Service, c.Name)
+		atomic.AddInt64(&mm.inFlight, 1)
+		start := nowFun()
+		panicked := true
+		//deferred, so a call panicking up to Recovery is still counted
+		defer func() {
+			seconds := nowFun().Sub(start).Seconds()
+			atomic.AddInt64(&mm.inFlight, -1)
+
+			outcome, _ := c.Outcome()
+			if panicked {
+				outcome = OutcomeError
+			}
+			for i, o := range outcomes {
+				if o == outcome {
+					atomic.AddUint64(&mm.requests[i], 1)
+				}
+			}
+			mm.mu.Lock()
+			if i := sort.SearchFloat64s(mm.buckets, seconds); i < len(mm.counts) {
+				mm.counts[i] += 1
+			}
+			mm.sum += seconds
+			mm.count += 1
+			mm.mu.Unlock()
+		}()
+		c.Next()
+		panicked = false
+	}
+}
+
+// InFlight returns the calls of method currently in the chain.
+func (m *Metrics) InFlight(service, method string) int64 {
+	return atomic.LoadInt64(&m.method(service, method).inFlight)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	bw := bufio.NewWriter(w)
+	m.write(bw, openMetrics)
+	bw.Flush()
+}
+
+func (m *Metrics) write(w *bufio.Writer, openMetrics bool) {
+	m.mu.RLock()
+	keys := make([]methodKey, 0, len(m.methods))
+	for key := range m.methods {
+		keys = append(keys, key)
+	}
+	methods := make([]*methodMetrics, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].method < keys[j].method
+	})
+	for i, key := range keys {
+		methods[i] = m.methods[key]
+	}
+	m.mu.RUnlock()
+
+	ns := m.Namespace
+	if ns != "" {
+		ns += "_"
+	}
+	labels := func(key methodKey) string {
+		return `service="` + escapeLabel(key.service) + `",method="` + escapeLabel(key.method) + `"`
+	}
+
+	name := ns + "requests"
+	if openMetrics {
+		fmt.Fprintf(w, "# TYPE %s counter\n# HELP %s Calls by method and outcome.\n", name, name)
+	} else {
+		fmt.Fprintf(w, "# HELP %s_total Calls by method and outcome.\n# TYPE %s_total counter\n", name, name)
+	}
+	for i, key := range keys {
+		for o, outcome := range outcomes {
+			fmt.Fprintf(w, "%s_total{%s,outcome=\"%s\"} %d\n", name, labels(key), outcome, atomic.LoadUint64(&methods[i].requests[o]))
+		}
+	}
+
+	name = ns + "in_flight"
+	fmt.Fprintf(w, "# HELP %s Calls in progress by method.\n# TYPE %s gauge\n", name, name)
+	for i, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, labels(key), atomic.LoadInt64(&methods[i].inFlight))
+	}
+
+	name = ns + "request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Call latency by method.\n# TYPE %s histogram\n", name, name)
+	for i, key := range keys {
+		mm := methods[i]
+		mm.mu.Lock()
+		var cumulative uint64
+		for b, bound := range mm.buckets {
+			cumulative += mm.counts[b]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels(key), formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels(key), mm.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels(key), formatFloat(mm.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels(key), mm.count)
+		mm.mu.Unlock()
+	}
+	if openMetrics {
+		w.WriteString("# EOF\n")
+	}
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
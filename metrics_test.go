@@ -0,0 +1,46 @@
+package thrifttools
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// callEcho calls Echo with s through mw and returns the message type of the
+// reply.
+func callEcho(t *testing.T, mw thrift.TProcessor, s string) thrift.TMessageType {
+	in, out := thrift.NewTMemoryBuffer(), thrift.NewTMemoryBuffer()
+	writeEcho(thrift.NewTBinaryProtocolTransport(in), s)
+	mw.Process(thrift.NewTBinaryProtocolTransport(in), thrift.NewTBinaryProtocolTransport(out))
+	_, typeId, _, err := thrift.NewTBinaryProtocolTransport(out).ReadMessageBegin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return typeId
+}
+
+func quietRecovery() HandlerFunc {
+	return RecoveryWithLogger(log.New(ioutil.Discard, "", 0))
+}
+
+func TestMetricsPanic(t *testing.T) {
+	m := NewMetrics()
+	mw := NewThriftMidWare(echoHandler{})
+	mw.Use(quietRecovery(), m.Middleware())
+	if typeId := callEcho(t, mw, "panic"); typeId != thrift.EXCEPTION {
+		t.Fatal(typeId)
+	}
+	if n := m.InFlight("", "Echo"); n != 0 {
+		t.Fatal("in flight", n)
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	if !strings.Contains(out, `thrift_server_requests_total{service="",method="Echo",outcome="error"} 1`) || !strings.Contains(out, `le="+Inf"} 1`) {
+		t.Fatal(out)
+	}
+}
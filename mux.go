@@ -0,0 +1,76 @@
+package thrifttools
+
+import (
+	"strings"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// ThriftMux serves several services on one transport, dispatching the
+// "service:method" message names written by TMultiplexedProtocol clients to
+// the ThriftMidWare registered for the service. HandlerFuncs added by Use run
+// for every service, before those of the service and of the method.
+type ThriftMux struct {
+	handlers []HandlerFunc
+	services map[string]*ThriftMidWare
+}
+
+func NewThriftMux() *ThriftMux {
+	return &ThriftMux{services: make(map[string]*ThriftMidWare)}
+}
+
+func (m *ThriftMux) Register(service string, midware *ThriftMidWare) {
+	midware.mux = m
+	m.services[service] = midware
+	midware.build()
+}
+
+// RegisterDefault serves message names without a service prefix, from
+// clients that are not multiplexed.
+func (m *ThriftMux) RegisterDefault(midware *ThriftMidWare) {
+	m.Register("", midware)
+}
+
+func (m *ThriftMux) Use(handles ...HandlerFunc) {
+	m.handlers = append(m.handlers, handles...)
+	for _, midware := range m.services {
+		midware.build()
+	}
+}
+
+func (m *ThriftMux) Process(iprot, oprot thrift.TProtocol) (success bool, err thrift.TException) {
+	return m.serve(nil, iprot, oprot)
+}
+
+// GetProcessor makes ThriftMux a thrift.TProcessorFactory, as
+// ThriftMidWare.GetProcessor.
+func (m *ThriftMux) GetProcessor(trans thrift.TTransport) thrift.TProcessor {
+	return &connProcessor{m.serve, trans}
+}
+
+func (m *ThriftMux) serve(trans thrift.TTransport, iprot, oprot thrift.TProtocol) (success bool, err thrift.TException) {
+	oprot = headerOutput(iprot, oprot)
+	name, typeId, seqId, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+	service, method := "", name
+	if i := strings.Index(name, thrift.MULTIPLEXED_SEPARATOR); i >= 0 {
+		service, method = name[:i], name[i+len(thrift.MULTIPLEXED_SEPARATOR):]
+	}
+	midware, ok := m.services[service]
+	if !ok {
+		iprot.Skip(thrift.STRUCT)
+		iprot.ReadMessageEnd()
+		x := thrift.NewTApplicationException(thrift.UNKNOWN_METHOD, "Unknown service "+service)
+		if typeId == thrift.ONEWAY {
+			return false, x
+		}
+		oprot.WriteMessageBegin(method, thrift.EXCEPTION, seqId)
+		x.Write(oprot)
+		oprot.WriteMessageEnd()
+		oprot.Flush()
+		return false, x
+	}
+	return midware.process(trans, service, method, typeId, seqId, iprot, oprot)
+}
@@ -2,27 +2,53 @@ package thrifttools
 
 import (
 	"container/list"
+	"context"
 	"errors"
+	"sort"
 	"sync"
 	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
 )
 
 type Pool struct {
-	Dial func() (interface{}, error)
-	Eclose func(c interface{}) error
+	Dial         func() (interface{}, error)
+	Eclose       func(c interface{}) error
 	TestOnBorrow func(c interface{}) error
 	AutoPut      func(p *Pool, c interface{}) error
-	MaxIdle int
-	MaxActive int
-	IdleTimeout time.Duration
+	MaxIdle      int
+	MaxActive    int
+	IdleTimeout  time.Duration
+	//connections of MaxActive that only PriorityHigh borrowers may use
+	Reserved int
+	//adaptive concurrency between MinActive and MaxActive, nil keeps MaxActive,
+	//starting at InitialActive or else MaxActive
+	Limiter       LimitAlgorithm
+	MinActive     int
+	InitialActive int
+	limit         float64
+	//call stats reported through Release
+	requests  int64
+	errors    int64
+	latencies [latencyWindow]time.Duration
+	latencyN  int
 	//waiting
 	Wait    bool
 	WaitNum int
-	mu     sync.Mutex
-	cond   *sync.Cond
-	closed bool
-	active int
-	idle list.List
+	waiters map[Priority]int
+	mu      sync.Mutex
+	cond    *sync.Cond
+	closed  bool
+	active  int
+	idle    list.List
 }
 
 var nowFun = time.Now
@@ -31,6 +57,18 @@ var (
 	ErrPoolExhausted = errors.New("The connection pool exhausted")
 )
 
+const latencyWindow = 256
+
+type PoolStats struct {
+	Active   int
+	Idle     int
+	Waiting  int
+	Requests int64
+	Errors   int64
+	//over the last latencyWindow calls since the window was last reset
+	P99 time.Duration
+}
+
 type idleConn struct {
 	c interface{}
 	t time.Time
@@ -57,10 +95,17 @@ func NewDefaultPool(
 }
 
 func (p *Pool) Get() (interface{}, error) {
-	c, err := p.get()
+	c, err := p.get(context.Background(), PriorityNormal)
 	return c, err
 }
 
+// GetWithPriority borrows a connection like Get. While the pool is exhausted,
+// returned connections are handed to the highest priority waiter first, and
+// waiting stops with ctx.Err() once ctx is done.
+func (p *Pool) GetWithPriority(ctx context.Context, prio Priority) (interface{}, error) {
+	return p.get(ctx, prio)
+}
+
 func (p *Pool) ActiveCount() int {
 	p.mu.Lock()
 	active := p.active
@@ -68,6 +113,53 @@ func (p *Pool) ActiveCount() int {
 	return active
 }
 
+// Limit returns the current concurrency limit, which is MaxActive unless
+// the pool has a Limiter.
+func (p *Pool) Limit() int {
+	p.mu.Lock()
+	limit := p.maxActive()
+	p.mu.Unlock()
+	return limit
+}
+
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	stats := PoolStats{
+		Active:   p.active,
+		Idle:     p.idle.Len(),
+		Waiting:  p.WaitNum,
+		Requests: p.requests,
+		Errors:   p.errors,
+	}
+	n := p.latencyN
+	if n > latencyWindow {
+		n = latencyWindow
+	}
+	latencies := make([]time.Duration, n)
+	copy(latencies, p.latencies[:n])
+	p.mu.Unlock()
+	if n > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		stats.P99 = latencies[(n*99-1)/100]
+	}
+	return stats
+}
+
+// resetLatencies starts a new latency window, so P99 covers only the calls
+// released after it.
+func (p *Pool) resetLatencies() {
+	p.mu.Lock()
+	p.latencyN = 0
+	p.mu.Unlock()
+}
+
+func (p *Pool) inUse() int {
+	p.mu.Lock()
+	n := p.active - p.idle.Len()
+	p.mu.Unlock()
+	return n
+}
+
 func (p *Pool) WaitNums() int {
 	p.mu.Lock()
 	waitNum := p.WaitNum
@@ -92,14 +184,104 @@ func (p *Pool) Close() error {
 
 func (p *Pool) release() {
 	p.active -= 1
-	if p.cond != nil {
-		p.cond.Signal()
+	p.wakeup()
+}
+
+// wakeup wakes every waiter, the highest priority one wins the connection.
+func (p *Pool) wakeup() {
+	if p.cond != nil && p.WaitNum > 0 {
+		p.cond.Broadcast()
 	}
 }
 
-func (p *Pool) get() (interface{}, error) {
-	p.mu.Lock()
+func (p *Pool) enqueue(prio Priority) {
+	if p.waiters == nil {
+		p.waiters = make(map[Priority]int)
+	}
+	p.waiters[prio] += 1
+	p.WaitNum += 1
+}
+
+func (p *Pool) dequeue(prio Priority) {
+	p.waiters[prio] -= 1
+	p.WaitNum -= 1
+	//lower priority waiters may be eligible now
+	p.wakeup()
+}
+
+// outranked reports whether a borrower of a higher priority is waiting.
+func (p *Pool) outranked(prio Priority) bool {
+	for wp, n := range p.waiters {
+		if wp > prio && n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// minActive returns the floor of the adaptive limit, which leaves normal
+// borrowers at least one connection beside the Reserved ones.
+func (p *Pool) minActive() int {
+	min := p.MinActive
+	if min < p.Reserved+1 {
+		min = p.Reserved + 1
+	}
+	if p.MaxActive > 0 && min > p.MaxActive {
+		min = p.MaxActive
+	}
+	return min
+}
+
+func (p *Pool) initialActive() float64 {
+	initial := p.InitialActive
+	if initial <= 0 || initial > p.MaxActive {
+		initial = p.MaxActive
+	}
+	if min := p.minActive(); initial < min {
+		initial = min
+	}
+	return float64(initial)
+}
+
+// maxActive returns the effective limit on active connections.
+func (p *Pool) maxActive() int {
+	if p.Limiter == nil || p.MaxActive == 0 {
+		return p.MaxActive
+	}
+	if p.limit == 0 {
+		p.limit = p.initialActive()
+	}
+	return int(p.limit)
+}
+
+// available reports whether a borrower of prio may take n connections now.
+func (p *Pool) available(prio Priority, n int) bool {
+	if p.MaxActive == 0 {
+		return true
+	}
+	limit := p.maxActive()
+	if prio < PriorityHigh {
+		limit -= p.Reserved
+	}
+	//a batch larger than the adaptive limit goes once nothing else is in
+	//use, instead of waiting for a limit it may never reach
+	if p.Limiter != nil && limit < n {
+		limit = n
+	}
+	return p.active-p.idle.Len()+n <= limit
+}
+
+func (p *Pool) watch(ctx context.Context, stop chan struct{}) {
+	select {
+	case <-ctx.Done():
+		p.mu.Lock()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	case <-stop:
+	}
+}
 
+func (p *Pool) prune() {
 	if timeout := p.IdleTimeout; timeout > 0 {
 		for i, n := 0, p.idle.Len(); i < n; i++ {
 			e := p.idle.Back()
@@ -118,60 +300,137 @@ func (p *Pool) get() (interface{}, error) {
 
 		}
 	}
+}
+
+// acquire waits until a borrower of prio may take n connections, then takes
+// up to n idle connections and reserves active slots to dial the rest.
+func (p *Pool) acquire(ctx context.Context, prio Priority, n int) (idle []interface{}, dials int, err error) {
+	p.mu.Lock()
+	p.prune()
+
+	waiting := false
+	var stop chan struct{}
+	defer func() {
+		if waiting {
+			p.dequeue(prio)
+		}
+		p.mu.Unlock()
+		if stop != nil {
+			close(stop)
+		}
+	}()
 	for {
-		for i, n := 0, p.idle.Len(); i < n; i++ {
-			e := p.idle.Front()
-			if e == nil {
-				break
+		if p.closed {
+			return nil, 0, errors.New("get on closed pool")
+		}
+		if !p.outranked(prio) && p.available(prio, n) {
+			for len(idle) < n && p.idle.Len() > 0 {
+				idle = append(idle, p.idle.Remove(p.idle.Front()).(idleConn).c)
 			}
-			ic := e.Value.(idleConn)
-			p.idle.Remove(e)
-			test := p.TestOnBorrow
-			p.mu.Unlock()
-			if test == nil || test(ic.c) == nil {
-	
-				return ic.c, nil
+			dials = n - len(idle)
+			p.active += dials
+			return idle, dials, nil
+		}
+		if !p.Wait {
+			return nil, 0, ErrPoolExhausted
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		if p.cond == nil {
+			p.cond = sync.NewCond(&p.mu)
+		}
+		if stop == nil && ctx.Done() != nil {
+			stop = make(chan struct{})
+			go p.watch(ctx, stop)
+		}
+		if !waiting {
+			waiting = true
+			p.enqueue(prio)
+		}
+		p.cond.Wait()
+	}
+}
+
+func (p *Pool) get(ctx context.Context, prio Priority) (interface{}, error) {
+	for {
+		idle, dials, err := p.acquire(ctx, prio, 1)
+		if err != nil {
+			return nil, err
+		}
+		if dials == 0 {
+			c := idle[0]
+			if test := p.TestOnBorrow; test == nil || test(c) == nil {
+				return c, nil
 			}
-			p.Eclose(ic.c)
+			p.Eclose(c)
 			p.mu.Lock()
 			p.release()
-		}
-		if p.closed {
 			p.mu.Unlock()
-			return nil, errors.New("get on closed pool")
+			continue
 		}
+		return p.dial()
+	}
+}
 
-		if p.MaxActive == 0 || p.active < p.MaxActive {
-			dial := p.Dial
-			p.active += 1
-			p.mu.Unlock()
-
-			c, err := dial()
-			if err != nil {
-				p.mu.Lock()
-				p.release()
-				p.mu.Unlock()
-				c = nil
-			} else if p.AutoPut != nil {
-				err = p.AutoPut(p, c)
-				if err != nil {
-					p.put(c, true)
-					c = nil
-				}
-			}
-			return c, err
+// dial opens a connection for an active slot already reserved by acquire.
+func (p *Pool) dial() (interface{}, error) {
+	c, err := p.Dial()
+	if err != nil {
+		p.mu.Lock()
+		p.release()
+		p.mu.Unlock()
+		c = nil
+	} else if p.AutoPut != nil {
+		err = p.AutoPut(p, c)
+		if err != nil {
+			p.put(c, true)
+			c = nil
+		}
+	}
+	return c, err
+}
 
+// GetN borrows n connections at once, or none. It waits until all n can be
+// taken together, so concurrent fan-out callers never hold part of a batch
+// while blocking on the rest. Return them with PutAll.
+func (p *Pool) GetN(ctx context.Context, n int) ([]interface{}, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	if p.MaxActive > 0 && n > p.MaxActive-p.Reserved {
+		return nil, ErrPoolExhausted
+	}
+	idle, dials, err := p.acquire(ctx, PriorityNormal, n)
+	if err != nil {
+		return nil, err
+	}
+	cs := make([]interface{}, 0, n)
+	test := p.TestOnBorrow
+	for _, c := range idle {
+		if test == nil || test(c) == nil {
+			cs = append(cs, c)
+			continue
 		}
-		if !p.Wait {
+		//dial a replacement in the slot of the broken connection
+		p.Eclose(c)
+		dials += 1
+	}
+	for ; dials > 0; dials-- {
+		c, err := p.dial()
+		if err != nil {
+			p.mu.Lock()
+			p.active -= dials - 1
+			p.wakeup()
 			p.mu.Unlock()
-			return nil, ErrPoolExhausted
+			p.PutAll(cs)
+			return nil, err
 		}
-		if p.cond == nil {
-			p.cond = sync.NewCond(&p.mu)
-		}
-		p.cond.Wait()
+		cs = append(cs, c)
 	}
+	return cs, nil
 }
+
 func (p *Pool) Put(c interface{}) error {
 	return p.put(c, false)
 }
@@ -180,7 +439,7 @@ func (p *Pool) put(c interface{}, forceClose bool) error {
 
 	if !p.closed && !forceClose {
 		p.idle.PushFront(idleConn{t: nowFun(), c: c})
-	
+
 		if p.idle.Len() > p.MaxIdle {
 			c = p.idle.Remove(p.idle.Back()).(idleConn).c
 		} else {
@@ -188,9 +447,7 @@ func (p *Pool) put(c interface{}, forceClose bool) error {
 		}
 	}
 	if c == nil {
-		if p.cond != nil {
-			p.cond.Signal()
-		}
+		p.wakeup()
 		p.mu.Unlock()
 		return nil
 	}
@@ -198,3 +455,79 @@ func (p *Pool) put(c interface{}, forceClose bool) error {
 	p.mu.Unlock()
 	return p.Eclose(c)
 }
+
+func (p *Pool) PutAll(cs []interface{}) error {
+	var err error
+	for _, c := range cs {
+		if err2 := p.Put(c); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Release returns a connection borrowed for one call, reporting how the call
+// went for Stats. Only transport, protocol and application exceptions count
+// as errors, not the declared exceptions of the call. Connections that failed
+// on the transport or protocol level are closed, and with a Limiter the
+// outcome adjusts the concurrency limit.
+func (p *Pool) Release(c interface{}, err error, latency time.Duration) error {
+	p.mu.Lock()
+	p.requests += 1
+	//declared exceptions and other business errors are successful calls
+	if !isFailure(err) {
+		err = nil
+	}
+	if err != nil {
+		p.errors += 1
+	}
+	p.latencies[p.latencyN%latencyWindow] = latency
+	p.latencyN += 1
+	if p.Limiter != nil && p.MaxActive > 0 {
+		if p.limit == 0 {
+			p.limit = p.initialActive()
+		}
+		inflight := p.active - p.idle.Len()
+		limit := p.Limiter.Update(p.limit, inflight, latency, err)
+		if min := float64(p.minActive()); limit < min {
+			limit = min
+		}
+		if max := float64(p.MaxActive); limit > max {
+			limit = max
+		}
+		p.limit = limit
+		p.wakeup()
+	}
+	p.mu.Unlock()
+	return p.put(c, isBroken(err))
+}
+
+// Do borrows a connection, calls fn with it and releases it with the result.
+func (p *Pool) Do(ctx context.Context, fn func(c interface{}) error) error {
+	c, err := p.GetWithPriority(ctx, PriorityNormal)
+	if err != nil {
+		return err
+	}
+	start := nowFun()
+	err = fn(c)
+	p.Release(c, err, nowFun().Sub(start))
+	return err
+}
+
+// isFailure reports whether err tells the backend or the connection failed,
+// as opposed to an error the call returned.
+func isFailure(err error) bool {
+	switch err.(type) {
+	case thrift.TTransportException, thrift.TProtocolException, thrift.TApplicationException:
+		return true
+	}
+	return false
+}
+
+func isBroken(err error) bool {
+	switch err.(type) {
+	case thrift.TTransportException, thrift.TProtocolException:
+		return true
+	}
+	return false
+}
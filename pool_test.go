@@ -0,0 +1,124 @@
+package thrifttools
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingPool returns a pool of MaxActive connections numbered in dial
+// order, failing the dials fail returns true for.
+func countingPool(maxActive int, fail func(n int64) bool) *Pool {
+	var dials int64
+	return &Pool{
+		Dial: func() (interface{}, error) {
+			n := atomic.AddInt64(&dials, 1)
+			if fail != nil && fail(n) {
+				return nil, errors.New("dial failed")
+			}
+			return n, nil
+		},
+		Eclose:    func(c interface{}) error { return nil },
+		MaxActive: maxActive,
+		MaxIdle:   maxActive,
+		Wait:      true,
+	}
+}
+
+func TestGetNRace(t *testing.T) {
+	p := countingPool(4, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 100; i++ {
+				cs, err := p.GetN(ctx, 1+r.Intn(4))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if n := p.ActiveCount(); n > 4 {
+					t.Error("active", n)
+				}
+				time.Sleep(time.Duration(r.Intn(100)) * time.Microsecond)
+				p.PutAll(cs)
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+	if n := p.ActiveCount(); n > 4 {
+		t.Fatal("active", n)
+	}
+}
+
+func TestGetNDialFailure(t *testing.T) {
+	p := countingPool(4, func(n int64) bool { return n == 3 })
+	p.Wait = false
+	if _, err := p.GetN(context.Background(), 3); err == nil {
+		t.Fatal("dial failure not returned")
+	}
+	if s := p.Stats(); s.Active != 2 || s.Idle != 2 {
+		t.Fatal("slots not given back", s)
+	}
+	cs, err := p.GetN(context.Background(), 4)
+	if err != nil || len(cs) != 4 || p.ActiveCount() != 4 {
+		t.Fatal(cs, err, p.ActiveCount())
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	p := countingPool(1, nil)
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan Priority, 2)
+	borrow := func(prio Priority) {
+		c, err := p.GetWithPriority(context.Background(), prio)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		served <- prio
+		p.Put(c)
+	}
+	waitFor := func(n int) {
+		for p.Stats().Waiting != n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	go borrow(PriorityLow)
+	waitFor(1)
+	go borrow(PriorityHigh)
+	waitFor(2)
+	p.Put(conn)
+	if first, second := <-served, <-served; first != PriorityHigh || second != PriorityLow {
+		t.Fatal("served", first, second)
+	}
+}
+
+func TestPriorityReserved(t *testing.T) {
+	p := countingPool(2, nil)
+	p.Reserved = 1
+	p.Wait = false
+	ctx := context.Background()
+	if _, err := p.GetWithPriority(ctx, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	for _, prio := range []Priority{PriorityLow, PriorityNormal} {
+		if _, err := p.GetWithPriority(ctx, prio); err != ErrPoolExhausted {
+			t.Fatal(prio, "took a reserved connection", err)
+		}
+	}
+	if _, err := p.GetWithPriority(ctx, PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+}
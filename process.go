@@ -1,6 +1,7 @@
 package thrifttools
 
 import (
+	"context"
 	"reflect"
 
 	"sync"
@@ -11,19 +12,33 @@ import (
 type HandlerFunc func(c *Context)
 type handlersChain []HandlerFunc
 
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 type ThriftProcessor interface {
 	GetProcessorFunction(key string) (processor thrift.TProcessorFunction, ok bool)
 	Process(iprot, oprot thrift.TProtocol) (success bool, err thrift.TException)
 }
 
 type ThriftMidWare struct {
-	thriftHandler  interface{}
-	handlers       []HandlerFunc
-	methodHandlers map[string][]HandlerFunc
-	pool           sync.Pool
-	methods        map[string]reflect.Value
-	insType        map[string][]reflect.Type
-	outsType       map[string][]reflect.Type
+	thriftHandler interface{}
+	handlers      []HandlerFunc
+	routes        []route
+	groups        map[string]*MethodGroup
+	chains        map[string]handlersChain
+	pool          sync.Pool
+	methods       map[string]reflect.Value
+	contexts      map[string]bool
+	insType       map[string][]reflect.Type
+	argIds        map[string]map[int16]int
+	argDefaults   map[string][]reflect.Value
+	outsType      map[string][]reflect.Type
+	outWires      map[string]map[int16]*wirePlan
+	codecs        map[string]*methodCodec
+	exceptions    map[string]map[reflect.Type]int16
+	statics       map[string]func() StaticCall
+	oneway        chan *Context
+	mux           *ThriftMux
+	errorMapper   ErrorMapper
 }
 
 func NewThriftMidWare(thriftHandler interface{}) *ThriftMidWare {
@@ -38,8 +53,14 @@ func NewThriftMidWare(thriftHandler interface{}) *ThriftMidWare {
 	handlerType := reflect.TypeOf(thriftHandler)
 	numMethod := handlerType.NumMethod()
 	middleware.methods = make(map[string]reflect.Value, numMethod)
+	middleware.contexts = make(map[string]bool, numMethod)
 	middleware.insType = make(map[string][]reflect.Type, numMethod)
+	middleware.argIds = make(map[string]map[int16]int, numMethod)
+	middleware.argDefaults = make(map[string][]reflect.Value, numMethod)
 	middleware.outsType = make(map[string][]reflect.Type, numMethod)
+	middleware.outWires = make(map[string]map[int16]*wirePlan, numMethod)
+	middleware.codecs = make(map[string]*methodCodec, numMethod)
+	middleware.exceptions = make(map[string]map[reflect.Type]int16, numMethod)
 
 	for m := 0; m < numMethod; m++ {
 		methodValue := handlerValue.Method(m)
@@ -47,56 +68,106 @@ func NewThriftMidWare(thriftHandler interface{}) *ThriftMidWare {
 		method := handlerType.Method(m)
 		middleware.methods[method.Name] = methodValue
 		numIn := methodType.NumIn()
-		ins := make([]reflect.Type, 0, numIn)
-		for i := 0; i < numIn; i++ {
+		first := 0
+		//a leading context.Context is passed from Context, not read off the wire
+		if numIn > 0 && methodType.In(0) == contextType {
+			middleware.contexts[method.Name] = true
+			first = 1
+		}
+		ins := make([]reflect.Type, 0, numIn-first)
+		ids := make(map[int16]int, numIn-first)
+		for i := first; i < numIn; i++ {
 			ins = append(ins, methodType.In(i))
+			ids[int16(i-first+1)] = i - first
 		}
 
 		middleware.insType[method.Name] = ins
+		middleware.argIds[method.Name] = ids
 		numOut := methodType.NumOut()
 		outs := make([]reflect.Type, 0, numOut)
 		for o := 0; o < numOut; o++ {
-			outs = append(outs, methodType.Out(0))
+			outs = append(outs, methodType.Out(o))
 		}
 		middleware.outsType[method.Name] = outs
+		middleware.compile(method.Name)
 	}
+	middleware.build()
 
 	return middleware
 }
 
+func (this *ThriftMidWare) compile(method string) {
+	this.codecs[method] = compileMethod(this.insType[method], this.outsType[method], this.argIds[method], this.argDefaults[method], this.outWires[method])
+}
+
 func (this *ThriftMidWare) allocateContext() *Context {
 	return &Context{Midware: this}
 }
 
 func (this *ThriftMidWare) Process(iprot, oprot thrift.TProtocol) (success bool, err thrift.TException) {
-	name, _, seqId, err := iprot.ReadMessageBegin()
+	return this.serve(nil, iprot, oprot)
+}
+
+// GetProcessor makes ThriftMidWare a thrift.TProcessorFactory, for servers
+// built with thrift.NewTSimpleServerFactory*, so Context.Transport is the
+// client connection itself.
+func (this *ThriftMidWare) GetProcessor(trans thrift.TTransport) thrift.TProcessor {
+	return &connProcessor{this.serve, trans}
+}
+
+func (this *ThriftMidWare) serve(trans thrift.TTransport, iprot, oprot thrift.TProtocol) (success bool, err thrift.TException) {
+	name, typeId, seqId, err := iprot.ReadMessageBegin()
 	if err != nil {
 		return false, err
 	}
+	return this.process(trans, "", name, typeId, seqId, iprot, oprot)
+}
 
+// process serves a call whose message header was read already.
+func (this *ThriftMidWare) process(trans thrift.TTransport, service, name string, typeId thrift.TMessageType, seqId int32, iprot, oprot thrift.TProtocol) (success bool, err thrift.TException) {
+	oprot = headerOutput(iprot, oprot)
 	c := this.pool.Get().(*Context)
 	c.reset()
 	c.SeqId = seqId
+	c.MessageType = typeId
 	c.Iprot = iprot
 	c.Oprot = oprot
+	c.Transport = trans
+	if trans == nil {
+		c.Transport = iprot.Transport()
+	}
+	if p := headerProtocol(iprot); p != nil {
+		//the transport reads the headers of the next frame meanwhile
+		c.requestHeaders = p.trans.ReadHeaders()
+	}
 
+	c.Service = service
 	c.Name = name
 	c.Midware = this
 	c.Method = this.methods[c.Name]
-	if !c.Method.IsValid() {
+	if newCall, ok := this.statics[c.Name]; ok {
+		c.Call = newCall()
+		err = c.Call.Read(c.Iprot)
+	} else if !c.Method.IsValid() {
 		c.Iprot.Skip(thrift.STRUCT)
 		c.Iprot.ReadMessageEnd()
 		x73 := thrift.NewTApplicationException(thrift.UNKNOWN_METHOD, "Unknown function "+c.Name)
+		if c.MessageType == thrift.ONEWAY {
+			return false, x73
+		}
 		c.Oprot.WriteMessageBegin(c.Name, thrift.EXCEPTION, c.SeqId)
 		x73.Write(c.Oprot)
 		c.Oprot.WriteMessageEnd()
 		c.Oprot.Flush()
 		return false, x73
+	} else {
+		c.Ins, err = this.codecs[c.Name].unpack(c.Iprot)
 	}
-
-	c.Ins, err = unpack(this.insType[c.Name], c.Iprot)
 	if err != nil {
 		c.Iprot.ReadMessageEnd()
+		if c.MessageType == thrift.ONEWAY {
+			return false, err
+		}
 		x := thrift.NewTApplicationException(thrift.PROTOCOL_ERROR, err.Error())
 		c.Oprot.WriteMessageBegin(c.Name, thrift.EXCEPTION, c.SeqId)
 		x.Write(c.Oprot)
@@ -106,53 +177,97 @@ func (this *ThriftMidWare) Process(iprot, oprot thrift.TProtocol) (success bool,
 	}
 	iprot.ReadMessageEnd()
 
+	if c.MessageType == thrift.ONEWAY && this.oneway != nil {
+		c.detach()
+		this.oneway <- c
+		return true, nil
+	}
 	defer this.pool.Put(c)
 	return this.doProcess(c)
 
 }
 func (this *ThriftMidWare) doProcess(c *Context) (success bool, err thrift.TException) {
 
-	c.handlers = this.handlers
-	if hls, ok := this.methodHandlers[c.Name]; ok {
-		c.handlers = append(c.handlers, hls...)
+	c.handlers = this.chains[c.Name]
+	c.Next()
+
+	if c.MessageType == thrift.ONEWAY {
+		//the client reads no reply
+		return true, this.onewayErr(c)
 	}
-	fn := func(c *Context) {
-		c.Outs = c.Method.Call(c.Ins)
+	if p := headerProtocol(c.Oprot); p != nil {
+		for k, v := range c.responseHeaders {
+			p.trans.SetWriteHeader(k, v)
+		}
 	}
 
-	c.handlers = append(c.handlers, fn)
-	c.Next()
-
-	for _, out := range c.Outs {
-		if !IsNull(out) {
-			switch out.Interface().(type) {
-			case ThriftException:
-			case error:
-				err := out.Interface().(error)
-				x := thrift.NewTApplicationException(thrift.INTERNAL_ERROR, "Internal error processing Set: "+err.Error())
-				c.Oprot.WriteMessageBegin(c.Name, thrift.EXCEPTION, c.SeqId)
-				x.Write(c.Oprot)
-				c.Oprot.WriteMessageEnd()
-				c.Oprot.Flush()
-				return true, err
+	var exception ThriftException
+	var exceptionId int16
+	var failure error
+	aborted := c.IsAbort() && c.Err != nil
+	if aborted {
+		failure = c.Err
+	} else if c.Call != nil {
+		if err, declared := c.Call.Err(); err != nil && !declared {
+			failure = err
+		}
+	} else {
+		for _, out := range c.Outs {
+			if !IsNull(out) {
+				if x, ok := out.Interface().(ThriftException); ok {
+					if id, ok := this.declaredId(c, x); ok {
+						exception, exceptionId = x, id
+						continue
+					}
+				}
+				if err, ok := out.Interface().(error); ok {
+					failure = err
+					break
+				}
 			}
 		}
 	}
 
-	if c.IsAbort() && c.Err != nil {
-		x := thrift.NewTApplicationException(thrift.INTERNAL_ERROR, "user middleware  error processing Set: "+c.Err.Error())
-		c.Oprot.WriteMessageBegin(c.Name, thrift.EXCEPTION, c.SeqId)
-		x.Write(c.Oprot)
-		c.Oprot.WriteMessageEnd()
-		c.Oprot.Flush()
-		return true, x
+	if failure != nil {
+		mapper := this.errorMapper
+		if mapper == nil {
+			mapper = DefaultErrorMapper
+		}
+		mapped := mapper(c, failure, aborted)
+		declared := false
+		if mapped.Exception != nil {
+			if id, ok := this.declaredId(c, mapped.Exception); ok {
+				exception, exceptionId, declared = mapped.Exception, id, true
+			} else {
+				mapped.TypeId, mapped.Message = thrift.INTERNAL_ERROR, "Internal error processing "+c.Name+": "+mapped.Exception.Error()
+			}
+		}
+		if !declared {
+			x := thrift.NewTApplicationException(mapped.TypeId, mapped.Message)
+			c.Oprot.WriteMessageBegin(c.Name, thrift.EXCEPTION, c.SeqId)
+			x.Write(c.Oprot)
+			c.Oprot.WriteMessageEnd()
+			c.Oprot.Flush()
+			if aborted {
+				//the chain rejected the call, which was answered
+				return true, nil
+			}
+			return true, failure
+		}
 	}
 	var err2 error
 	restuts_name := c.Name + "_result"
 	if err2 = c.Oprot.WriteMessageBegin(c.Name, thrift.REPLY, c.SeqId); err2 != nil {
 		err = err2
 	}
-	if err2 = pack(restuts_name, c.Outs, c.Oprot); err == nil && err2 != nil {
+	if exception != nil {
+		err2 = packException(restuts_name, exceptionId, exception, c.Oprot)
+	} else if c.Call != nil {
+		err2 = c.Call.Write(c.Oprot)
+	} else {
+		err2 = this.codecs[c.Name].pack(restuts_name, c.Outs, c.Oprot)
+	}
+	if err == nil && err2 != nil {
 		err = err2
 	}
 	if err2 = c.Oprot.WriteMessageEnd(); err == nil && err2 != nil {
@@ -167,16 +282,139 @@ func (this *ThriftMidWare) doProcess(c *Context) (success bool, err thrift.TExce
 	return true, err
 }
 
+// connProcessor serves the calls of one client connection.
+type connProcessor struct {
+	serve func(trans thrift.TTransport, iprot, oprot thrift.TProtocol) (bool, thrift.TException)
+	trans thrift.TTransport
+}
+
+func (p *connProcessor) Process(iprot, oprot thrift.TProtocol) (success bool, err thrift.TException) {
+	return p.serve(p.trans, iprot, oprot)
+}
+
+func (this *ThriftMidWare) onewayErr(c *Context) thrift.TException {
+	if c.Call != nil {
+		if err, _ := c.Call.Err(); err != nil {
+			return err
+		}
+	}
+	for _, out := range c.Outs {
+		if !IsNull(out) {
+			if err, ok := out.Interface().(error); ok {
+				return err
+			}
+		}
+	}
+	if c.IsAbort() && c.Err != nil {
+		return c.Err
+	}
+	return nil
+}
+
+// OnewayWorkers runs oneway calls on workers goroutines instead of the
+// connection goroutine, so a slow oneway handler does not hold up the next
+// request. Up to queue calls wait for a worker before Process blocks. The
+// workers do not see the connection: Iprot, Oprot and Transport of their
+// Context are nil, RemoteAddr, Conn and RequestHeaders still answer.
+// It panics if workers is less than 1 or the workers are already running.
+func (this *ThriftMidWare) OnewayWorkers(workers, queue int) {
+	if workers < 1 {
+		panic("thrifttools: OnewayWorkers needs at least one worker")
+	}
+	if this.oneway != nil {
+		panic("thrifttools: OnewayWorkers called twice")
+	}
+	this.oneway = make(chan *Context, queue)
+	for i := 0; i < workers; i++ {
+		go func(calls chan *Context) {
+			for c := range calls {
+				this.doProcess(c)
+				this.pool.Put(c)
+			}
+		}(this.oneway)
+	}
+}
+
+// MethodArgs maps the fields of method's arguments by the generated *_args
+// struct, whose fields are in parameter order and tagged with their ids. Pass
+// it as built by the generated New*Args to use its field values as defaults
+// for arguments the client leaves out. Without it argument i+1 is field id i.
+func (this *ThriftMidWare) MethodArgs(method string, args interface{}) {
+	v := reflect.Indirect(reflect.ValueOf(args))
+	ins := this.insType[method]
+	if v.NumField() != len(ins) {
+		panic("thrifttools: " + v.Type().Name() + " does not match the arguments of " + method)
+	}
+	ids := make(map[int16]int, len(ins))
+	defaults := make([]reflect.Value, len(ins))
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		id, ok := fieldId(field.Tag)
+		if !ok || field.Type != ins[i] {
+			panic("thrifttools: field " + field.Name + " does not match argument of " + method)
+		}
+		ids[id] = i
+		defaults[i] = v.Field(i)
+	}
+	this.argIds[method] = ids
+	this.argDefaults[method] = defaults
+	this.compile(method)
+}
+
+// MethodFieldIds maps the arguments of method to explicit field ids, ids[i]
+// being the id of argument i.
+func (this *ThriftMidWare) MethodFieldIds(method string, ids ...int16) {
+	m := make(map[int16]int, len(ids))
+	for i, id := range ids {
+		m[id] = i
+	}
+	this.argIds[method] = m
+	this.compile(method)
+}
+
+// MethodResult declares the exceptions of method from its generated *_result
+// struct, e.g. MethodResult("Get", &gen.ServiceGetResult{}). A returned
+// exception is then written to the field of its type with no success value,
+// and exceptions of other types are reported as INTERNAL_ERROR. The success
+// value is written with the wire types the struct uses, so enum results go
+// out as I32 like generated clients read them. Without it the method
+// declares no exceptions, and every exception is reported as INTERNAL_ERROR.
+func (this *ThriftMidWare) MethodResult(method string, result interface{}) {
+	t := reflect.TypeOf(result)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	ids := make(map[reflect.Type]int16)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if id, ok := fieldId(field.Tag); ok && id != 0 {
+			ids[field.Type] = id
+		}
+	}
+	this.exceptions[method] = ids
+	if _, ok := this.methods[method]; ok {
+		this.outWires[method] = resultWires(t)
+		this.compile(method)
+	}
+}
+
+// declaredId returns the result field of x when the method of c declares it,
+// by MethodResult or a generated call. There is no fallback field, as the
+// client would drop an exception in a field it does not know, so the
+// exceptions of other types are failures replied as INTERNAL_ERROR.
+func (this *ThriftMidWare) declaredId(c *Context, x ThriftException) (int16, bool) {
+	if call, ok := c.Call.(StaticExceptions); ok {
+		return call.ExceptionId(x)
+	}
+	id, ok := this.exceptions[c.Name][reflect.TypeOf(x)]
+	return id, ok
+}
+
 func (this *ThriftMidWare) Use(handles ...HandlerFunc) {
 	this.handlers = append(this.handlers, handles...)
+	this.build()
 }
 
 func (this *ThriftMidWare) MethodUse(method string, handles ...HandlerFunc) {
-
-	if _, ok := this.methodHandlers[method]; ok {
-		this.methodHandlers[method] = append(this.methodHandlers[method], handles...)
-	} else {
-		handlers := handlersChain(handles)
-		this.methodHandlers[method] = handlers
-	}
+	this.route(func(name string) bool { return name == method }, handles)
 }
@@ -0,0 +1,94 @@
+package thrifttools
+
+import (
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// NotFound is a declared exception the way the Go generator writes them.
+type NotFound struct {
+	Key string
+}
+
+func (e *NotFound) Error() string  { return "not found: " + e.Key }
+func (e *NotFound) String() string { return e.Error() }
+
+func (e *NotFound) Read(iprot thrift.TProtocol) error {
+	return iprot.Skip(thrift.STRUCT)
+}
+
+func (e *NotFound) Write(oprot thrift.TProtocol) error {
+	oprot.WriteStructBegin("NotFound")
+	oprot.WriteFieldBegin("key", thrift.STRING, 1)
+	oprot.WriteString(e.Key)
+	oprot.WriteFieldEnd()
+	oprot.WriteFieldStop()
+	return oprot.WriteStructEnd()
+}
+
+type lookupHandler struct{}
+
+func (lookupHandler) Lookup(key string) (string, error) {
+	return "", &NotFound{key}
+}
+
+type lookupResult struct {
+	Success *string   `thrift:"success,0"`
+	Missing *NotFound `thrift:"missing,2"`
+}
+
+// lookup calls Lookup through mw and returns the message type of the reply
+// and the id of its first field, or the type id of the exception.
+func lookup(t *testing.T, mw *ThriftMidWare) (thrift.TMessageType, int32) {
+	in, out := thrift.NewTMemoryBuffer(), thrift.NewTMemoryBuffer()
+	iprot, oprot := thrift.NewTBinaryProtocolTransport(in), thrift.NewTBinaryProtocolTransport(out)
+	iprot.WriteMessageBegin("Lookup", thrift.CALL, 1)
+	iprot.WriteStructBegin("Lookup_args")
+	iprot.WriteFieldBegin("key", thrift.STRING, 1)
+	iprot.WriteString("k")
+	iprot.WriteFieldEnd()
+	iprot.WriteFieldStop()
+	iprot.WriteStructEnd()
+	mw.Process(iprot, oprot)
+	_, typeId, _, err := oprot.ReadMessageBegin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typeId == thrift.EXCEPTION {
+		x, _ := thrift.NewTApplicationException(0, "").Read(oprot)
+		return typeId, x.(thrift.TApplicationException).TypeId()
+	}
+	oprot.ReadStructBegin()
+	_, _, fieldId, _ := oprot.ReadFieldBegin()
+	return typeId, int32(fieldId)
+}
+
+func TestUndeclaredException(t *testing.T) {
+	mw := NewThriftMidWare(lookupHandler{})
+	var outcome string
+	mw.Use(func(c *Context) { c.Next(); outcome, _ = c.Outcome() })
+	if typeId, id := lookup(t, mw); typeId != thrift.EXCEPTION || id != thrift.INTERNAL_ERROR || outcome != OutcomeError {
+		t.Fatal(typeId, id, outcome)
+	}
+	mw.MethodResult("Lookup", &lookupResult{})
+	if typeId, id := lookup(t, mw); typeId != thrift.REPLY || id != 2 || outcome != OutcomeException {
+		t.Fatal(typeId, id, outcome)
+	}
+}
+
+func TestOnewayWorkersMisuse(t *testing.T) {
+	panics := func(f func()) (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		f()
+		return
+	}
+	mw := NewThriftMidWare(lookupHandler{})
+	if !panics(func() { mw.OnewayWorkers(0, 1) }) {
+		t.Fatal("no workers accepted")
+	}
+	mw.OnewayWorkers(1, 1)
+	if !panics(func() { mw.OnewayWorkers(1, 1) }) {
+		t.Fatal("second call accepted")
+	}
+}
@@ -0,0 +1,164 @@
+package thrifttools
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// ExceptionRateLimited is the TApplicationException type id clients get for
+// calls rejected by RateLimit, past the type ids thrift defines.
+const ExceptionRateLimited int32 = 100
+
+// RateLimitError aborts the calls over a RateLimit limit.
+type RateLimitError struct {
+	Method string
+	//caller key, empty when the method limit was hit
+	Caller string
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Caller != "" {
+		return fmt.Sprintf("rate limit exceeded calling %s by %s", e.Method, e.Caller)
+	}
+	return "rate limit exceeded calling " + e.Method
+}
+
+func (e *RateLimitError) TypeId() int32 {
+	return ExceptionRateLimited
+}
+
+// Limit is a token bucket refilled with Rate tokens a second up to Burst,
+// which defaults to Rate rounded up.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+type RateLimitOptions struct {
+	//limits shared by all callers of a method, by method name or "*" for
+	//the methods not listed
+	Methods map[string]Limit
+	//limits of each caller of a method, keyed the same way
+	Callers map[string]Limit
+	//Key identifies the caller, the client IP by default. Calls it returns
+	//"" for, such as those of transports without a Conn, skip the caller
+	//limits rather than share one bucket
+	Key func(c *Context) string
+}
+
+// RateLimit rejects the calls exceeding the method or caller limits with a
+// RateLimitError before they reach the rest of the chain.
+func RateLimit(opts RateLimitOptions) HandlerFunc {
+	rl := &rateLimiter{opts: opts, buckets: make(map[bucketKey]*tokenBucket)}
+	if rl.opts.Key == nil {
+		rl.opts.Key = peerIP
+	}
+	return rl.handle
+}
+
+type bucketKey struct {
+	method, caller string
+	perCaller      bool
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	opts RateLimitOptions
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+}
+
+func (rl *rateLimiter) handle(c *Context) {
+	now := nowFun()
+	rl.mu.Lock()
+	rl.sweep(now)
+	var err *RateLimitError
+	//the caller bucket is checked first, so the calls refused to a caller
+	//do not drain the method bucket shared with the others
+	var caller *tokenBucket
+	if l, ok := limitFor(rl.opts.Callers, c.Name); ok {
+		//an unknown caller is only held to the method limits
+		if key := rl.opts.Key(c); key != "" {
+			if caller = rl.refill(bucketKey{c.Name, key, true}, l, now); caller.tokens < 1 {
+				err = &RateLimitError{Method: c.Name, Caller: key}
+			}
+		}
+	}
+	if l, ok := limitFor(rl.opts.Methods, c.Name); ok && err == nil {
+		if b := rl.refill(bucketKey{method: c.Name}, l, now); b.tokens < 1 {
+			err = &RateLimitError{Method: c.Name}
+		} else {
+			b.tokens -= 1
+		}
+	}
+	if caller != nil && err == nil {
+		caller.tokens -= 1
+	}
+	rl.mu.Unlock()
+	if err != nil {
+		c.AbortWithError(err)
+	}
+}
+
+func limitFor(limits map[string]Limit, method string) (Limit, bool) {
+	if l, ok := limits[method]; ok {
+		return l, true
+	}
+	l, ok := limits["*"]
+	return l, ok
+}
+
+// refill returns the bucket of key refilled for the time since its last
+// call. It is called with rl.mu held.
+func (rl *rateLimiter) refill(key bucketKey, l Limit, now time.Time) *tokenBucket {
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst(), last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst(), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	return b
+}
+
+// sweep drops, once a minute, the caller buckets refilled by now, which a new
+// bucket would match anyway, so callers seen once do not pile up.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	for key, b := range rl.buckets {
+		l, _ := limitFor(rl.opts.Callers, key.method)
+		if key.perCaller && b.tokens+now.Sub(b.last).Seconds()*l.Rate >= l.burst() {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+func peerIP(c *Context) string {
+	addr := c.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,40 @@
+package thrifttools
+
+import (
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+func TestRateLimitCallerFirst(t *testing.T) {
+	caller := "abuser"
+	mw := NewThriftMidWare(echoHandler{})
+	mw.Use(RateLimit(RateLimitOptions{
+		Methods: map[string]Limit{"*": {Rate: 0.001, Burst: 10}},
+		Callers: map[string]Limit{"*": {Rate: 0.001, Burst: 1}},
+		Key:     func(c *Context) string { return caller },
+	}))
+	for i := 0; i < 10; i++ {
+		want := thrift.EXCEPTION
+		if i == 0 {
+			want = thrift.REPLY
+		}
+		if typeId := callEcho(t, mw, "hello"); typeId != want {
+			t.Fatal(i, typeId)
+		}
+	}
+	caller = "innocent"
+	if typeId := callEcho(t, mw, "hello"); typeId != thrift.REPLY {
+		t.Fatal("method bucket drained by refused calls")
+	}
+}
+
+func TestRateLimitNoCallerKey(t *testing.T) {
+	mw := NewThriftMidWare(echoHandler{})
+	mw.Use(RateLimit(RateLimitOptions{Callers: map[string]Limit{"*": {Rate: 0.001, Burst: 1}}}))
+	for i := 0; i < 3; i++ {
+		if typeId := callEcho(t, mw, "hello"); typeId != thrift.REPLY {
+			t.Fatal(i, typeId)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package thrifttools
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+)
+
+// Printer is where built-in middleware writes its log lines, satisfied by
+// *log.Logger.
+type Printer interface {
+	Printf(format string, v ...interface{})
+}
+
+// errPanicked is the error middleware records for a call panicking through
+// it, which Recovery further up the chain replies as a PanicError.
+var errPanicked = errors.New("panic")
+
+// PanicError is set on Context.Err when Recovery catches a panic.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Recovery catches panics in the rest of the chain and the handler, logging
+// them to stderr.
+func Recovery() HandlerFunc {
+	return RecoveryWithLogger(log.New(os.Stderr, "", log.LstdFlags))
+}
+
+// RecoveryWithLogger catches panics in the rest of the chain and the
+// handler, logs them with their stack to logger and aborts the call with a
+// PanicError, which the client gets as an INTERNAL_ERROR
+// TApplicationException instead of a dropped connection. Use it before
+// Timeout, which raises the panics of the handler again on the caller.
+func RecoveryWithLogger(logger Printer) HandlerFunc {
+	return func(c *Context) {
+		defer func() {
+			if v := recover(); v != nil {
+				err := &PanicError{Value: v, Stack: debug.Stack()}
+				if logger != nil {
+					logger.Printf("thrifttools: panic processing %s seqid %d: %v\n%s", c.Name, c.SeqId, v, err.Stack)
+				}
+				c.AbortWithError(err)
+			}
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,321 @@
+package thrifttools
+
+import (
+	"fmt"
+	"reflect"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// The reflective codec methodCodec replaced, walking the kinds of the
+// arguments and results on every call. It is kept here as the baseline of
+// the codec benchmarks and of TestCodecMatchesReflect, not served from.
+
+// unpack decodes the args struct of a call into the handler arguments. Fields
+// are matched to arguments by ids, unknown fields and fields of an unexpected
+// wire type are skipped, and missing arguments take their defaults or zero.
+func unpack(instype []reflect.Type, ids map[int16]int, defaults []reflect.Value, iprot thrift.TProtocol) (args []reflect.Value, err error) {
+
+	if _, err = iprot.ReadStructBegin(); err != nil {
+		err = thrift.PrependError(fmt.Sprintf("read  args error: "), err)
+		return
+	}
+	args = make([]reflect.Value, len(instype))
+	for {
+		_, fieldTypeId, fieldId, err2 := iprot.ReadFieldBegin()
+		if err2 != nil {
+			err = thrift.PrependError(fmt.Sprintf("field %d read error: ", fieldId), err2)
+			return
+		}
+		if fieldTypeId == thrift.STOP {
+			break
+		}
+
+		if i, ok := ids[fieldId]; ok && i < len(instype) && matches(instype[i], fieldTypeId) {
+			v, err2 := readValue(instype[i], fieldTypeId, iprot)
+			if err2 != nil {
+				err = err2
+				return
+			}
+			args[i] = v
+		} else if err = iprot.Skip(fieldTypeId); err != nil {
+			err = thrift.PrependError(fmt.Sprintf("field %d skip error: ", fieldId), err)
+			return
+		}
+
+		if err = iprot.ReadFieldEnd(); err != nil {
+			return
+		}
+	}
+
+	if err = iprot.ReadStructEnd(); err != nil {
+		err = thrift.PrependError(fmt.Sprintf("read struct end error: "), err)
+		return
+	}
+	for i, v := range args {
+		if v.IsValid() {
+			continue
+		}
+		if i < len(defaults) && defaults[i].IsValid() {
+			args[i] = copyValue(defaults[i])
+		} else {
+			args[i] = reflect.Zero(instype[i])
+		}
+	}
+	return args, nil
+}
+
+// readValue reads a value that arrived with wire type into tpy.
+func readValue(tpy reflect.Type, wire thrift.TType, iprot thrift.TProtocol) (reflect.Value, error) {
+	if wire == thrift.I32 && isEnum(tpy) {
+		in, err := iprot.ReadI32()
+		if err != nil {
+			return reflect.Value{}, thrift.PrependError("error reading field: ", err)
+		}
+		return reflect.ValueOf(int64(in)).Convert(tpy), nil
+	}
+	return readArg(tpy, iprot)
+}
+
+func readArg(tpy reflect.Type, iprot thrift.TProtocol) (value reflect.Value, err error) {
+	var err2 error
+	switch tpy.Kind() {
+	case reflect.Bool:
+		var in bool
+		if in, err = iprot.ReadBool(); err != nil {
+			err2 = thrift.PrependError("error reading field: ", err)
+		} else {
+			value = reflect.ValueOf(in)
+		}
+	case reflect.Int8:
+		var in int8
+		if in, err = iprot.ReadByte(); err != nil {
+			err2 = thrift.PrependError("error reading field: ", err)
+		} else {
+			value = reflect.ValueOf(in)
+		}
+	case reflect.Int16:
+		var in int16
+		if in, err = iprot.ReadI16(); err != nil {
+			err2 = thrift.PrependError("error reading field: ", err)
+		} else {
+			value = reflect.ValueOf(in)
+		}
+	case reflect.Int32:
+		var in int32
+		if in, err = iprot.ReadI32(); err != nil {
+			err2 = thrift.PrependError("error reading field: ", err)
+		} else {
+			value = reflect.ValueOf(in)
+		}
+	case reflect.Int64:
+		var in int64
+		if in, err = iprot.ReadI64(); err != nil {
+			err2 = thrift.PrependError("error reading field: ", err)
+		} else {
+			value = reflect.ValueOf(in)
+		}
+
+	case reflect.Float64:
+		var in float64
+		if in, err = iprot.ReadDouble(); err != nil {
+			err2 = thrift.PrependError("error reading field: ", err)
+		} else {
+			value = reflect.ValueOf(in)
+		}
+	case reflect.Map:
+		kwire, vwire, size, err := iprot.ReadMapBegin()
+		if err != nil {
+			err2 = thrift.PrependError("error reading map begin: ", err)
+			break
+		}
+		value = reflect.MakeMap(tpy)
+		for i := 0; i < size; i++ {
+			k, err := readValue(tpy.Key(), kwire, iprot)
+			if err != nil {
+				err2 = err
+				break
+			}
+			v, err := readValue(tpy.Elem(), vwire, iprot)
+			if err != nil {
+				err2 = err
+				break
+			}
+			value.SetMapIndex(k, v)
+		}
+		if err = iprot.ReadMapEnd(); err != nil {
+			err2 = thrift.PrependError("error reading map end: ", err)
+		}
+	case reflect.Ptr:
+		in := reflect.New(tpy.Elem())
+		err = in.Interface().(ThriftReader).Read(iprot)
+		if err != nil {
+			err2 = err
+			break
+		}
+		value = in
+	case reflect.Slice:
+		if tpy.Elem().Kind() == reflect.Uint8 {
+			var in []byte
+			if in, err = iprot.ReadBinary(); err != nil {
+				err2 = thrift.PrependError("error reading field: ", err)
+			} else {
+				value = reflect.ValueOf(in)
+			}
+			break
+		}
+		ewire, size, err := iprot.ReadListBegin()
+		if err != nil {
+			err2 = thrift.PrependError("error reading list begin: ", err)
+			break
+		}
+		value = reflect.MakeSlice(tpy, 0, size)
+		for i := 0; i < size; i++ {
+			v, err := readValue(tpy.Elem(), ewire, iprot)
+			if err != nil {
+				err2 = err
+				break
+			}
+			value = reflect.Append(value, v)
+		}
+		if err := iprot.ReadListEnd(); err != nil {
+			err2 = thrift.PrependError("error reading list end: ", err)
+		}
+	case reflect.String:
+		var in string
+		if in, err = iprot.ReadString(); err != nil {
+			err2 = thrift.PrependError("error reading field: ", err)
+		} else {
+			value = reflect.ValueOf(in)
+		}
+	case reflect.Struct:
+		value = reflect.Zero(tpy)
+		err = value.Interface().(ThriftReader).Read(iprot)
+		if err != nil {
+			err2 = err
+			break
+		}
+	default:
+
+	}
+	if err2 == nil && value.IsValid() && value.Type() != tpy {
+		//named types such as enums
+		value = value.Convert(tpy)
+	}
+	return value, err2
+}
+
+func pack(result_name string, results []reflect.Value, oprot thrift.TProtocol) (err error) {
+	if err := oprot.WriteStructBegin(result_name); err != nil {
+		return thrift.PrependError(fmt.Sprintf("%s write struct begin error: ", result_name), err)
+	}
+	idx := 0
+	if len(results) == 1 {
+		idx = 1
+	}
+	for _, out := range results {
+		if !IsNull(out) {
+			if err := oprot.WriteFieldBegin("", ttype(out.Type()), int16(idx)); err != nil {
+				return thrift.PrependError(fmt.Sprintf("write field begin error."), err)
+			}
+			err = writeResult(out, oprot)
+			if err != nil {
+				return
+			}
+			if err = oprot.WriteFieldEnd(); err != nil {
+				return thrift.PrependError(fmt.Sprintf("write field end error."), err)
+			}
+		}
+		idx += 1
+	}
+	if err := oprot.WriteFieldStop(); err != nil {
+		return thrift.PrependError("write field stop error: ", err)
+	}
+	if err := oprot.WriteStructEnd(); err != nil {
+		return thrift.PrependError("write struct stop error: ", err)
+	}
+	return nil
+}
+
+func writeResult(out reflect.Value, oprot thrift.TProtocol) (err error) {
+
+	switch out.Kind() {
+	case reflect.Bool:
+		if err := oprot.WriteBool(out.Bool()); err != nil {
+			return thrift.PrependError(fmt.Sprintf("Bool write error."), err)
+		}
+	case reflect.Int8:
+		if err := oprot.WriteByte(int8(out.Int())); err != nil {
+			return thrift.PrependError(fmt.Sprintf("Int8 write error."), err)
+		}
+	case reflect.Int16:
+		if err := oprot.WriteI16(int16(out.Int())); err != nil {
+			return thrift.PrependError(fmt.Sprintf("Int16 write error."), err)
+		}
+	case reflect.Int32:
+		if err := oprot.WriteI32(int32(out.Int())); err != nil {
+			return thrift.PrependError(fmt.Sprintf("Int32 write error."), err)
+		}
+	case reflect.Int64:
+		if err := oprot.WriteI64(out.Int()); err != nil {
+			return thrift.PrependError(fmt.Sprintf("Int64 write error."), err)
+		}
+	case reflect.Float64:
+		if err := oprot.WriteDouble(out.Float()); err != nil {
+			return thrift.PrependError(fmt.Sprintf("Float64 write error."), err)
+		}
+	case reflect.Map:
+		if err := oprot.WriteMapBegin(ttype(out.Type().Key()), ttype(out.Type().Elem()), out.Len()); err != nil {
+			return thrift.PrependError("error writing map begin: ", err)
+		}
+		for _, v := range out.MapKeys() {
+			if err := writeResult(v, oprot); err != nil {
+				return thrift.PrependError(fmt.Sprintf("map field write error."), err)
+			}
+
+			if err := writeResult(out.MapIndex(v), oprot); err != nil {
+				return thrift.PrependError(fmt.Sprintf("map field write error."), err)
+			}
+		}
+		if err := oprot.WriteMapEnd(); err != nil {
+			return thrift.PrependError("error writing map end: ", err)
+		}
+	case reflect.Interface:
+		fallthrough
+	case reflect.Ptr:
+		err := out.Interface().(ThriftWriter).Write(oprot)
+		if err != nil {
+			return err
+		}
+	case reflect.Slice:
+		if out.Type().Elem().Kind() == reflect.Uint8 {
+			if err := oprot.WriteBinary(out.Bytes()); err != nil {
+				return thrift.PrependError(fmt.Sprintf("Binary write error."), err)
+			}
+			break
+		}
+		if err := oprot.WriteListBegin(ttype(out.Type().Elem()), out.Len()); err != nil {
+			return thrift.PrependError("error writing list begin: ", err)
+		}
+		for i := 0; i < out.Len(); i++ {
+			if err := writeResult(out.Index(i), oprot); err != nil {
+				return thrift.PrependError(fmt.Sprintf("list write error: "), err)
+			}
+		}
+		if err := oprot.WriteListEnd(); err != nil {
+			return thrift.PrependError("error writing list end: ", err)
+		}
+	case reflect.String:
+		if err := oprot.WriteString(out.String()); err != nil {
+			return thrift.PrependError(fmt.Sprintf("String write error."), err)
+		}
+	case reflect.Struct:
+		err := out.Interface().(ThriftWriter).Write(oprot)
+		if err != nil {
+			return err
+		}
+	default:
+
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package thrifttools
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+const defaultReplicas = 160
+
+// hashRing places every endpoint on a ring at Replicas virtual nodes, so that
+// adding or removing one endpoint only moves the keys of its own nodes.
+type hashRing struct {
+	hashes    []uint64
+	endpoints []*Endpoint
+}
+
+func newHashRing(endpoints []*Endpoint, replicas int) *hashRing {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	r := &hashRing{
+		hashes:    make([]uint64, 0, len(endpoints)*replicas),
+		endpoints: make([]*Endpoint, 0, len(endpoints)*replicas),
+	}
+	owners := make(map[uint64]*Endpoint, len(endpoints)*replicas)
+	for _, e := range endpoints {
+		for i := 0; i < replicas; i++ {
+			h := hashKey(e.Addr + "#" + strconv.Itoa(i))
+			if _, ok := owners[h]; !ok {
+				owners[h] = e
+				r.hashes = append(r.hashes, h)
+			}
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	for _, h := range r.hashes {
+		r.endpoints = append(r.endpoints, owners[h])
+	}
+	return r
+}
+
+// get returns the first endpoint clockwise from key that passes ok.
+func (r *hashRing) get(key string, ok func(e *Endpoint) bool) *Endpoint {
+	n := len(r.hashes)
+	if n == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	i := sort.Search(n, func(i int) bool { return r.hashes[i] >= h })
+	for j := 0; j < n; j++ {
+		if e := r.endpoints[(i+j)%n]; ok(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+func hashKey(key string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	//fnv alone clusters on keys sharing a prefix, finish with a mixer
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,120 @@
+package thrifttools
+
+import (
+	"path"
+	"reflect"
+	"regexp"
+)
+
+// route adds handlers to the chain of every method it matches.
+type route struct {
+	match    func(method string) bool
+	handlers []HandlerFunc
+}
+
+// MethodGroup is a named set of methods sharing middleware, such as the admin
+// methods of a service. Members are method names or path.Match patterns.
+type MethodGroup struct {
+	Name     string
+	midware  *ThriftMidWare
+	patterns []string
+}
+
+// Match reports whether method belongs to the group.
+func (g *MethodGroup) Match(method string) bool {
+	for _, pattern := range g.patterns {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Add puts more methods in the group, also under the middleware added
+// before.
+func (g *MethodGroup) Add(methods ...string) *MethodGroup {
+	g.patterns = append(g.patterns, methods...)
+	g.midware.build()
+	return g
+}
+
+func (g *MethodGroup) Use(handles ...HandlerFunc) *MethodGroup {
+	g.midware.route(g.Match, handles)
+	return g
+}
+
+// Group returns the group called name, creating it on first use, with
+// methods added to it.
+func (this *ThriftMidWare) Group(name string, methods ...string) *MethodGroup {
+	if this.groups == nil {
+		this.groups = make(map[string]*MethodGroup)
+	}
+	g, ok := this.groups[name]
+	if !ok {
+		g = &MethodGroup{Name: name, midware: this}
+		this.groups[name] = g
+	}
+	return g.Add(methods...)
+}
+
+// PatternUse adds handlers to the methods matching a path.Match pattern,
+// e.g. "Get*".
+func (this *ThriftMidWare) PatternUse(pattern string, handles ...HandlerFunc) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic("thrifttools: bad method pattern " + pattern)
+	}
+	this.route(func(name string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}, handles)
+}
+
+// RegexpUse adds handlers to the methods matching a regular expression.
+func (this *ThriftMidWare) RegexpUse(expr string, handles ...HandlerFunc) {
+	re := regexp.MustCompile(expr)
+	this.route(re.MatchString, handles)
+}
+
+func (this *ThriftMidWare) route(match func(method string) bool, handles []HandlerFunc) {
+	this.routes = append(this.routes, route{match, handles})
+	this.build()
+}
+
+// build precomputes the handler chain of every method: the handlers of the
+// mux, of the service and of the routes matching the method in the order
+// they were added, ending with the call of the handler.
+func (this *ThriftMidWare) build() {
+	chains := make(map[string]handlersChain, len(this.methods)+len(this.statics))
+	chain := func(method string) handlersChain {
+		var hls handlersChain
+		if this.mux != nil {
+			hls = append(hls, this.mux.handlers...)
+		}
+		hls = append(hls, this.handlers...)
+		for _, r := range this.routes {
+			if r.match(method) {
+				hls = append(hls, r.handlers...)
+			}
+		}
+		return append(hls, this.call)
+	}
+	for method := range this.methods {
+		chains[method] = chain(method)
+	}
+	for method := range this.statics {
+		chains[method] = chain(method)
+	}
+	this.chains = chains
+}
+
+func (this *ThriftMidWare) call(c *Context) {
+	if c.Call != nil {
+		c.Call.Call(c)
+		return
+	}
+	ins := c.Ins
+	if this.contexts[c.Name] {
+		ins = append([]reflect.Value{reflect.ValueOf(c.Context())}, c.Ins...)
+	}
+	c.Outs = c.Method.Call(ins)
+}
@@ -0,0 +1,39 @@
+package thrifttools
+
+import (
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// StaticCall is one call of a method of a processor generated by
+// thrifttools-gen. It decodes and encodes the generated *_args and *_result
+// structs and calls the handler directly, without reflection.
+type StaticCall interface {
+	Read(iprot thrift.TProtocol) error
+	Call(c *Context)
+	//Err returns the handler error and whether it is a declared exception,
+	//already set on the result
+	Err() (err error, declared bool)
+	Write(oprot thrift.TProtocol) error
+}
+
+// StaticExceptions is implemented by generated calls of methods declaring
+// exceptions. ExceptionId returns the result field of a declared exception,
+// where an ErrorMapper's exception for the call is written.
+type StaticExceptions interface {
+	ExceptionId(x error) (int16, bool)
+}
+
+// NewStaticMidWare builds a ThriftMidWare over generated calls keyed by the
+// thrift method name. It runs the same HandlerFunc chain and Context as
+// NewThriftMidWare, with Context.Call set in place of Method, Ins and Outs.
+func NewStaticMidWare(thriftHandler interface{}, calls map[string]func() StaticCall) *ThriftMidWare {
+	middleware := &ThriftMidWare{
+		thriftHandler: thriftHandler,
+		statics:       calls,
+	}
+	middleware.pool.New = func() interface{} {
+		return middleware.allocateContext()
+	}
+	middleware.build()
+	return middleware
+}
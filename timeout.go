@@ -0,0 +1,115 @@
+package thrifttools
+
+import (
+	"context"
+	"log"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// ExceptionTimeout is the TApplicationException type id clients get for
+// calls the Timeout middleware gave up on.
+const ExceptionTimeout int32 = 102
+
+// TimeoutError aborts the calls the handler did not finish in time.
+type TimeoutError struct {
+	Method  string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return "timed out after " + e.Timeout.String() + " processing " + e.Method
+}
+
+func (e *TimeoutError) TypeId() int32 {
+	return ExceptionTimeout
+}
+
+// Timeout gives the rest of the chain d to finish, see Timeouts.
+func Timeout(d time.Duration) HandlerFunc {
+	return Timeouts(d, nil)
+}
+
+// Timeouts sets a deadline of methods[c.Name], or d for the methods not
+// listed, on the call context and runs the rest of the chain on another
+// goroutine. If the deadline passes first the call is aborted with a
+// TimeoutError, replied to the client at once, and the result of the
+// handler is dropped when it returns. Calls without a timeout run as usual.
+//
+// A panic of the handler in time is raised again on the calling goroutine,
+// so Recovery must be used before Timeout to catch it. A panic after the
+// deadline has no call left to fail and is logged to stderr, see
+// TimeoutsWithLogger.
+func Timeouts(d time.Duration, methods map[string]time.Duration) HandlerFunc {
+	return TimeoutsWithLogger(d, methods, log.New(os.Stderr, "", log.LstdFlags))
+}
+
+// TimeoutsWithLogger is Timeouts logging the panics of handlers past their
+// deadline with their stack to logger.
+func TimeoutsWithLogger(d time.Duration, methods map[string]time.Duration, logger Printer) HandlerFunc {
+	return func(c *Context) {
+		timeout, ok := methods[c.Name]
+		if !ok {
+			timeout = d
+		}
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+
+		parent := c.ctx
+		ctx, cancel := context.WithTimeout(c.Context(), timeout)
+		//the handler works on a copy, so c can be replied and reused while
+		//it still runs
+		cc := c.clone()
+		cc.WithContext(ctx)
+		done := make(chan struct{})
+		var panicked interface{}
+		var stack []byte
+		go func() {
+			defer func() {
+				if panicked = recover(); panicked != nil {
+					stack = debug.Stack()
+				}
+				close(done)
+			}()
+			cc.Next()
+		}()
+
+		select {
+		case <-done:
+			cancel()
+			if panicked != nil {
+				cc.release()
+				panic(panicked)
+			}
+			c.Outs = cc.Outs
+			c.Err = cc.Err
+			c.index = cc.index
+			cc.mu.RLock()
+			for k, v := range cc.Keys {
+				c.Set(k, v)
+			}
+			for k, v := range cc.responseHeaders {
+				c.SetResponseHeader(k, v)
+			}
+			cc.mu.RUnlock()
+			c.ctx = parent
+			cc.release()
+		case <-ctx.Done():
+			//a static call writes its result into c.Call, so leave it to
+			//the handler
+			c.Call = nil
+			c.AbortWithError(&TimeoutError{Method: c.Name, Timeout: timeout})
+			go func() {
+				<-done
+				cancel()
+				if panicked != nil && logger != nil {
+					logger.Printf("thrifttools: panic processing %s seqid %d after timeout: %v\n%s", cc.Name, cc.SeqId, panicked, stack)
+				}
+				cc.release()
+			}()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package thrifttools
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// slowHandler blocks Echo("block") until unblock is closed.
+type slowHandler struct {
+	unblock chan struct{}
+}
+
+func (h slowHandler) Echo(s string) (string, error) {
+	if s == "block" {
+		<-h.unblock
+	}
+	return s, nil
+}
+
+func TestTimeoutLateHandler(t *testing.T) {
+	h := slowHandler{make(chan struct{})}
+	mw := NewThriftMidWare(h)
+	var late sync.WaitGroup
+	late.Add(1)
+	mw.Use(func(c *Context) {
+		if _, ok := c.Get("late"); ok {
+			t.Error("pooled Context kept the key of a late handler")
+		}
+		c.Next()
+	}, Timeout(10*time.Millisecond), func(c *Context) {
+		c.Next()
+		//run with -race: the late handler must only touch its own copy
+		c.Set("late", true)
+		c.SetResponseHeader("late", "true")
+		c.Outs = nil
+		if c.Context().Err() != nil {
+			late.Done()
+		}
+	})
+
+	in, out := thrift.NewTMemoryBuffer(), thrift.NewTMemoryBuffer()
+	writeEcho(thrift.NewTBinaryProtocolTransport(in), "block")
+	returned := make(chan struct{})
+	go func() {
+		mw.Process(thrift.NewTBinaryProtocolTransport(in), thrift.NewTBinaryProtocolTransport(out))
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply before the handler returned")
+	}
+	oprot := thrift.NewTBinaryProtocolTransport(out)
+	if _, typeId, _, err := oprot.ReadMessageBegin(); err != nil || typeId != thrift.EXCEPTION {
+		t.Fatal(typeId, err)
+	}
+	x, _ := thrift.NewTApplicationException(0, "").Read(oprot)
+	if id := x.(thrift.TApplicationException).TypeId(); id != ExceptionTimeout {
+		t.Fatal("exception", id)
+	}
+
+	//reuse the pooled Contexts while the late handler finishes
+	close(h.unblock)
+	for i := 0; i < 20; i++ {
+		if typeId := callEcho(t, mw, "hello"); typeId != thrift.REPLY {
+			t.Fatal(typeId)
+		}
+	}
+	late.Wait()
+	for i := 0; i < 20; i++ {
+		if typeId := callEcho(t, mw, "hello"); typeId != thrift.REPLY {
+			t.Fatal(typeId)
+		}
+	}
+}
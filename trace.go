@@ -0,0 +1,285 @@
+package thrifttools
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+
+	SpanKindServer = "server"
+	SpanKindClient = "client"
+
+	SpanStatusOK    = "ok"
+	SpanStatusError = "error"
+)
+
+// SpanContext identifies a span across processes, as a W3C traceparent.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+	//tracestate passed along unchanged
+	State string
+}
+
+// ParseTraceparent reads a W3C traceparent header,
+// version-traceid-spanid-flags in lowercase hex.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+	if !isHex(parts[0]) || !isHex(parts[1]) || len(parts[1]) != 32 || !isHex(parts[2]) || len(parts[2]) != 16 || !isHex(parts[3]) || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return SpanContext{}, false
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return SpanContext{TraceID: parts[1], SpanID: parts[2], Sampled: flags[0]&1 == 1}, true
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Traceparent formats sc as a W3C traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+// Span is one call traced on the server or the client.
+type Span struct {
+	SpanContext
+	ParentSpanID  string
+	Name          string
+	Kind          string
+	Start         time.Time
+	End           time.Time
+	Status        string
+	StatusMessage string
+	Attributes    map[string]interface{}
+
+	tracer *Tracer
+	once   sync.Once
+}
+
+// SetAttribute records a key and value on the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]interface{})
+	}
+	s.Attributes[key] = value
+}
+
+// Finish ends the span, in error if err is not nil, and exports it if it is
+// sampled. Only the first call counts.
+func (s *Span) Finish(err error) {
+	s.once.Do(func() {
+		s.End = nowFun()
+		s.Status = SpanStatusOK
+		if err != nil {
+			s.Status, s.StatusMessage = SpanStatusError, err.Error()
+		}
+		if s.Sampled && s.tracer != nil && s.tracer.Exporter != nil {
+			s.tracer.Exporter.ExportSpan(s)
+		}
+	})
+}
+
+func (s *Span) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"trace_id":       s.TraceID,
+		"span_id":        s.SpanID,
+		"parent_span_id": s.ParentSpanID,
+		"name":           s.Name,
+		"kind":           s.Kind,
+		"start":          s.Start,
+		"end":            s.End,
+		"duration_us":    s.End.Sub(s.Start).Microseconds(),
+		"status":         s.Status,
+		"status_message": s.StatusMessage,
+		"attributes":     s.Attributes,
+	})
+}
+
+// SpanExporter receives the finished sampled spans.
+type SpanExporter interface {
+	ExportSpan(s *Span)
+}
+
+// JSONLinesExporter writes spans as one JSON object per line.
+type JSONLinesExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSONLinesExporter(w io.Writer) *JSONLinesExporter {
+	return &JSONLinesExporter{w: w}
+}
+
+// NewFileExporter appends spans as JSON lines to the file at path.
+func NewFileExporter(path string) (*JSONLinesExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLinesExporter(f), nil
+}
+
+func (e *JSONLinesExporter) ExportSpan(s *Span) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	e.w.Write(append(b, '\n'))
+	e.mu.Unlock()
+}
+
+// Close closes the writer of the exporter if it is an io.Closer.
+func (e *JSONLinesExporter) Close() error {
+	if c, ok := e.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type spanKey struct{}
+
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Tracer creates spans for calls, continuing the trace of the caller or
+// starting a new one, for SampleRate of the new traces, 1 if zero.
+type Tracer struct {
+	Exporter   SpanExporter
+	SampleRate float64
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{Exporter: exporter}
+}
+
+// StartSpan starts a span, child of parent if it is valid.
+func (t *Tracer) StartSpan(name, kind string, parent SpanContext) *Span {
+	s := &Span{Name: name, Kind: kind, Start: nowFun(), tracer: t}
+	s.SpanID = randomHex(8)
+	if parent.TraceID != "" {
+		s.TraceID, s.ParentSpanID = parent.TraceID, parent.SpanID
+		s.Sampled, s.State = parent.Sampled, parent.State
+		return s
+	}
+	s.TraceID = randomHex(16)
+	rate := t.SampleRate
+	if rate <= 0 {
+		rate = 1
+	}
+	//sample by trace id so every process of the trace agrees
+	b, _ := hex.DecodeString(s.TraceID[:8])
+	s.Sampled = rate >= 1 || float64(uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8|uint32(b[3])) < rate*math.MaxUint32
+	return s
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	for {
+		rand.Read(b)
+		for _, c := range b {
+			if c != 0 {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+}
+
+// Middleware traces the calls of the rest of the chain as server spans,
+// reading the trace of the caller from the traceparent THeader header. The
+// span is on the call context.Context, for client calls made by the
+// handler, and an error status is recorded for declared exceptions,
+// application errors and aborted calls.
+func (t *Tracer) Middleware() HandlerFunc {
+	return func(c *Context) {
+		headers := c.RequestHeaders()
+		parent, _ := ParseTraceparent(headers[TraceparentHeader])
+		if parent.TraceID != "" {
+			parent.State = headers[TracestateHeader]
+		}
+		name := c.Name
+		if c.Service != "" {
+			name = c.Service + ":" + c.Name
+		}
+		span := t.StartSpan(name, SpanKindServer, parent)
+		span.SetAttribute("rpc.system", "thrift")
+		span.SetAttribute("rpc.method", c.Name)
+		if c.Service != "" {
+			span.SetAttribute("rpc.service", c.Service)
+		}
+		span.SetAttribute("thrift.seqid", c.SeqId)
+		if addr := c.RemoteAddr(); addr != nil {
+			span.SetAttribute("net.peer.addr", addr.String())
+		}
+		c.WithContext(ContextWithSpan(c.Context(), span))
+		c.SetResponseHeader(TraceparentHeader, span.Traceparent())
+
+		panicked := true
+		//deferred, so the span of a call panicking up to Recovery ends
+		defer func() {
+			outcome, err := c.Outcome()
+			if panicked {
+				outcome, err = OutcomeError, errPanicked
+			}
+			span.SetAttribute("thrift.outcome", outcome)
+			span.Finish(err)
+		}()
+		c.Next()
+		panicked = false
+	}
+}
+
+// StartClientSpan is the client side hook: it starts a client span for a
+// call of method, child of the span of ctx, and sets its trace context on
+// the headers of the next message of trans. Finish the span with the error
+// of the call.
+func (t *Tracer) StartClientSpan(ctx context.Context, method string, trans *THeaderTransport) *Span {
+	var parent SpanContext
+	if s := SpanFromContext(ctx); s != nil {
+		parent = s.SpanContext
+	}
+	span := t.StartSpan(method, SpanKindClient, parent)
+	span.SetAttribute("rpc.system", "thrift")
+	span.SetAttribute("rpc.method", method)
+	if trans != nil {
+		trans.SetWriteHeader(TraceparentHeader, span.Traceparent())
+		if span.State != "" {
+			trans.SetWriteHeader(TracestateHeader, span.State)
+		}
+	}
+	return span
+}
@@ -0,0 +1,19 @@
+package thrifttools
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTracerPanic(t *testing.T) {
+	var out bytes.Buffer
+	tr := NewTracer(NewJSONLinesExporter(&out))
+	mw := NewThriftMidWare(echoHandler{})
+	mw.Use(quietRecovery(), tr.Middleware())
+	callEcho(t, mw, "panic")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"status":"error"`) || !strings.Contains(lines[0], `"thrift.outcome":"error"`) {
+		t.Fatal(lines)
+	}
+}